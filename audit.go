@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log is an append-only record of moderation and security events,
+// one JSON object per line. It is kept apart from the chat and never holds
+// message content: entries name who did what to whom, and why.
+
+// Moderation entries use the action's name (kick, mute or ban) as event.
+const (
+	auditUnban             = "unban"
+	auditBannedConnection  = "banned_connection"
+	auditAuthSuccess       = "auth_success"
+	auditAuthFailure       = "auth_failure"
+	auditFederationReject  = "federation_rejected"
+	auditFederationAuthErr = "federation_auth_failure"
+	auditPeerChange        = "peer_change"
+)
+
+const (
+	defaultAuditMaxSizeMB = 10
+	defaultAuditKeep      = 5
+)
+
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Actor       string    `json:"actor,omitempty"`       // User, moderator or admin key behind the event
+	Server      string    `json:"server,omitempty"`      // Server the actor is on, for federated actions
+	User        string    `json:"user,omitempty"`        // Nick of the local user affected
+	Login       string    `json:"login,omitempty"`       // GitHub login involved
+	Fingerprint string    `json:"fingerprint,omitempty"` // SSH key fingerprint involved
+	Network     string    `json:"network,omitempty"`     // IP address or range involved
+	Peer        string    `json:"peer,omitempty"`        // Federation peer address
+	Command     string    `json:"command,omitempty"`     // Admin command, e.g. "fed add"
+	Role        string    `json:"role,omitempty"`        // Role granted on GitHub auth
+	Reason      string    `json:"reason,omitempty"`
+	Expires     time.Time `json:"expires,omitzero"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// AuditLog appends entries to a file and rotates it once it grows past
+// maxSize, keeping the last keep files as path.1 (newest) to path.<keep>.
+// A nil *AuditLog records nothing.
+type AuditLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+func openAuditLog(path string, maxSize int64, keep int) (*AuditLog, error) {
+	a := &AuditLog{path: path, maxSize: maxSize, keep: keep}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	root, name, err := openRootForPath(a.path)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// record stamps entry with the current time and appends it. Failures are
+// logged rather than returned: auditing must never stop the chat.
+func (a *AuditLog) record(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry %s: %v", entry.Event, err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("Failed to rotate audit log: %v", err)
+			if a.file == nil {
+				return
+			}
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, moves the current
+// file to path.1 and starts a new one. If the files cannot be moved, the
+// current file is reopened so entries keep being appended to it.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		log.Printf("Failed to close audit log: %v", err)
+	}
+	a.file = nil
+
+	if err := a.shift(); err != nil {
+		if openErr := a.open(); openErr != nil {
+			return errors.Join(err, openErr)
+		}
+		return err
+	}
+	return a.open()
+}
+
+// shift moves the log files one place down for rotate.
+func (a *AuditLog) shift() error {
+	root, name, err := openRootForPath(a.path)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	if a.keep > 0 {
+		_ = root.Remove(fmt.Sprintf("%s.%d", name, a.keep))
+		for i := a.keep - 1; i >= 1; i-- {
+			_ = root.Rename(fmt.Sprintf("%s.%d", name, i), fmt.Sprintf("%s.%d", name, i+1))
+		}
+		if err := root.Rename(name, name+".1"); err != nil {
+			return err
+		}
+	} else if err := root.Remove(name); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// auditLog returns the hub's audit log; a nil hub has none.
+func (h *Hub) auditLog() *AuditLog {
+	if h == nil {
+		return nil
+	}
+	return h.audit
+}
+
+// sessionEntry is an entry about a local user, identified by nick, proven
+// login, key and address.
+func sessionEntry(event string, c *Client) auditEntry {
+	entry := auditEntry{Event: event, User: c.User(), Fingerprint: c.KeyFingerprint()}
+	if c.IsAuthed() {
+		entry.Login = c.User()
+	}
+	if addr := c.RemoteAddr(); addr.IsValid() {
+		entry.Network = addr.String()
+	}
+	return entry
+}
+
+// unbanEntry records actor lifting the bans on target, which /unban takes
+// as a login, key fingerprint or address.
+func unbanEntry(actor, target string) auditEntry {
+	entry := auditEntry{Event: auditUnban, Actor: actor}
+	if network, ok := parseBanNetwork(target); ok {
+		entry.Network = network
+	} else if strings.HasPrefix(target, "SHA256:") {
+		entry.Fingerprint = target
+	} else {
+		entry.Login = target
+	}
+	return entry
+}
+
+// moderationEntry describes action for the audit log; user is the local
+// nick it was enforced on, "" when it was only recorded.
+func moderationEntry(action moderationAction, user string) auditEntry {
+	return auditEntry{
+		Event:       action.Action,
+		Actor:       action.Issuer,
+		Server:      action.Server,
+		User:        user,
+		Login:       action.Login,
+		Fingerprint: action.Fingerprint,
+		Network:     action.Network,
+		Reason:      action.Reason,
+		Expires:     action.Expires,
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// readAudit returns the entries in the audit log file at path.
+func readAudit(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open audit log: %v", err)
+	}
+	defer f.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("audit line %q is not JSON: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLogRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path, 300, 2)
+	if err != nil {
+		t.Fatalf("openAuditLog error: %v", err)
+	}
+	defer audit.Close()
+
+	for i := 0; i < 20; i++ {
+		audit.record(auditEntry{Event: auditAuthFailure, User: fmt.Sprintf("user%02d", i), Error: "expired device code"})
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat %s: %v", name, err)
+		}
+		if info.Size() > 300 {
+			t.Fatalf("%s is %d bytes, want at most 300", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("only keep old files should be kept")
+	}
+	entries := readAudit(t, path)
+	if last := entries[len(entries)-1]; last.User != "user19" || last.Time.IsZero() {
+		t.Fatalf("last entry = %+v, want the newest one with a time", last)
+	}
+
+	var none *AuditLog
+	none.record(auditEntry{Event: auditAuthFailure})
+}
+
+func TestAuditLogKeepsWritingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// A directory in the way of audit.log.1 makes every rotation fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "in-the-way"), 0700); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+	audit, err := openAuditLog(path, 200, 1)
+	if err != nil {
+		t.Fatalf("openAuditLog error: %v", err)
+	}
+	defer audit.Close()
+
+	for i := 0; i < 10; i++ {
+		audit.record(auditEntry{Event: auditAuthFailure, User: fmt.Sprintf("user%02d", i), Error: "expired device code"})
+	}
+	entries := readAudit(t, path)
+	if len(entries) != 10 || entries[9].User != "user09" {
+		t.Fatalf("audit log has %d entries, want all 10 appended after failed rotations", len(entries))
+	}
+}
+
+func TestAuditModerationAndPeerChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path, 1<<20, 1)
+	if err != nil {
+		t.Fatalf("openAuditLog error: %v", err)
+	}
+	defer audit.Close()
+
+	h := newHub()
+	h.audit = audit
+	f, err := NewFederation(h, FederationConfig{ServerName: "alpha", KnownHostsPath: filepath.Join(t.TempDir(), "known_hosts")}, nil)
+	if err != nil {
+		t.Fatalf("NewFederation error: %v", err)
+	}
+	h.federation = f
+
+	troll := &Client{hub: h, user: "troll", send: make(chan Message, 10), fingerprint: "SHA256:troll"}
+	h.clients[troll] = true
+	h.clientsByName["troll"] = troll
+	h.roles = map[string]string{"octocat": roleAdmin}
+	admin := &Client{hub: h, user: "octocat", send: make(chan Message, 10), isAuthed: true}
+	h.grantRole(admin)
+
+	h.applyModeration(moderationAction{Action: moderationMute, Issuer: "mod", Server: "alpha", Fingerprint: "SHA256:troll", Reason: "secret plans", Expires: time.Now().Add(time.Hour)})
+	h.applyModeration(moderationAction{Action: moderationBan, Issuer: "mod", Login: "absent"})
+	handleCommand(admin, "/unban absent", nil)
+	runFederationCommand(f, nil, "octocat", "/fed", []string{"disable", "127.0.0.1:1"})
+	peerSigner := newTestSigner(t)
+	keyFields := strings.Fields(string(cryptossh.MarshalAuthorizedKey(peerSigner.PublicKey())))
+	runFederationCommand(f, nil, "octocat", "/fed", []string{"add", "127.0.0.1:1", keyFields[0], keyFields[1], "s3cret"})
+	_ = f.RemovePeer("127.0.0.1:1")
+
+	entries := readAudit(t, path)
+	want := []string{auditAuthSuccess, moderationMute, moderationBan, auditUnban, auditPeerChange}
+	if len(entries) != len(want) {
+		t.Fatalf("audit entries = %+v, want events %v", entries, want)
+	}
+	for i, event := range want {
+		if entries[i].Event != event {
+			t.Fatalf("entry %d = %+v, want event %s", i, entries[i], event)
+		}
+	}
+	if entries[0].Login != "octocat" || entries[0].Role != roleAdmin {
+		t.Fatalf("auth entry = %+v", entries[0])
+	}
+	if e := entries[1]; e.User != "troll" || e.Actor != "mod" || e.Fingerprint != "SHA256:troll" || e.Expires.IsZero() {
+		t.Fatalf("mute entry = %+v", e)
+	}
+	if e := entries[2]; e.User != "" || e.Login != "absent" {
+		t.Fatalf("ban entry = %+v, want the ban recorded without a local user", e)
+	}
+	if e := entries[4]; e.Actor != "octocat" || e.Command != "/fed add" || e.Peer != "127.0.0.1:1" || !strings.HasPrefix(e.Fingerprint, "SHA256:") {
+		t.Fatalf("peer entry = %+v", e)
+	}
+}
+
+func TestAuditUnbanWhenSavingFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path, 1<<20, 1)
+	if err != nil {
+		t.Fatalf("openAuditLog error: %v", err)
+	}
+	defer audit.Close()
+
+	h := newHub()
+	h.audit = audit
+	// The ban list lives in a directory that does not exist, so every save fails.
+	h.bans = &BanList{path: filepath.Join(t.TempDir(), "missing", "bans.json")}
+	if err := h.bans.add(moderationAction{Action: moderationBan, Issuer: "mod", Login: "absent"}); err == nil {
+		t.Fatal("saving the ban list should fail")
+	}
+	mod := &Client{hub: h, user: "mod", isAuthed: true, role: roleModerator, send: make(chan Message, 10)}
+	reply, _ := handleCommand(mod, "/unban absent", nil)
+	if !strings.Contains(reply.Content, "saving the ban list failed") {
+		t.Fatalf("/unban reply = %q, want the save failure reported", reply.Content)
+	}
+
+	entries := readAudit(t, path)
+	if len(entries) != 1 || entries[0].Event != auditUnban || entries[0].Login != "absent" || entries[0].Error == "" {
+		t.Fatalf("audit entries = %+v, want the unban recorded with the save error", entries)
+	}
+}
+
+func TestAuditReauthenticationUnderCurrentName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path, 1<<20, 1)
+	if err != nil {
+		t.Fatalf("openAuditLog error: %v", err)
+	}
+	defer audit.Close()
+
+	h := newHub()
+	h.audit = audit
+	f, err := NewFederation(h, FederationConfig{}, nil)
+	if err != nil {
+		t.Fatalf("NewFederation error: %v", err)
+	}
+	h.federation = f
+	h.roles = map[string]string{"octocat": roleModerator}
+	go h.run()
+
+	c := &Client{hub: h, user: "octocat", send: make(chan Message, 10)}
+	h.register <- c
+	<-c.send // own join notice
+
+	// Signing in under the name already in use still counts.
+	h.requestNameChange(c, "octocat", true)
+	if msg := <-c.send; msg.Content != "You are signed in as moderator." {
+		t.Fatalf("c got %q, want the role notice", msg.Content)
+	}
+	if !c.IsAuthed() || c.Role() != roleModerator {
+		t.Fatalf("c authed %v with role %q, want an authenticated moderator", c.IsAuthed(), c.Role())
+	}
+	entries := readAudit(t, path)
+	if len(entries) != 1 || entries[0].Event != auditAuthSuccess || entries[0].Login != "octocat" || entries[0].Role != roleModerator {
+		t.Fatalf("audit entries = %+v, want one auth_success for octocat", entries)
+	}
+}
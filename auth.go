@@ -12,6 +12,41 @@ import (
 	"golang.org/x/oauth2/github"
 )
 
+// authProviderGitHub names GitHub in the auth provider fields of federation
+// payloads.
+const authProviderGitHub = "github"
+
+// Anonymous policies, set with `anonymous` in [chat], decide what users who
+// have not authenticated with /gh may do.
+const (
+	anonymousAllowed  = "allowed"   // Everything, as authenticated users
+	anonymousReadOnly = "read-only" // Read and look around, but not post or DM
+	anonymousBlocked  = "blocked"   // Nothing until /gh succeeds; they are not even let in
+)
+
+// anonymousCommands lists what anonymous users may still run under each
+// restrictive policy.
+var anonymousCommands = map[string]map[string]bool{
+	anonymousReadOnly: {"/h": true, "/u": true, "/gh": true, "/j": true, "/l": true, "/rooms": true, "/s": true},
+	anonymousBlocked:  {"/h": true, "/gh": true},
+}
+
+// anonymousRefusal explains why c may not run command under the policy, or
+// returns "" if it may. An empty command stands for a public message.
+func anonymousRefusal(c *Client, policy, command string) string {
+	if policy == anonymousAllowed || c.IsAuthed() || anonymousCommands[policy][command] {
+		return ""
+	}
+	switch {
+	case policy == anonymousBlocked:
+		return "This server only admits GitHub users. Use /gh to authenticate and join the chat."
+	case command == "":
+		return "Anonymous users can only read here. Use /gh to authenticate with GitHub and post."
+	default:
+		return fmt.Sprintf("Anonymous users cannot use %s here. Use /gh to authenticate with GitHub first.", command)
+	}
+}
+
 // The "Device Flow" option should be enabled in the application settings on GitHub.
 func handleAuthentication(client *Client, cfg *Config) {
 	defer client.FinishAuthAttempt()
@@ -28,6 +63,7 @@ func handleAuthentication(client *Client, cfg *Config) {
 	code, err := conf.DeviceAuth(deviceCtx)
 	if err != nil {
 		client.EnqueueMessage(SystemMessage(fmt.Sprintf("GitHub auth error: could not get device code: %v", err)))
+		auditAuthFailed(client, err)
 		return
 	}
 
@@ -43,6 +79,7 @@ func handleAuthentication(client *Client, cfg *Config) {
 	token, err := conf.DeviceAccessToken(pollCtx, code)
 	if err != nil {
 		client.EnqueueMessage(SystemMessage(fmt.Sprintf("GitHub auth error: failed to get access token: %v", err)))
+		auditAuthFailed(client, err)
 		return
 	}
 
@@ -51,6 +88,7 @@ func handleAuthentication(client *Client, cfg *Config) {
 	username, err := getGitHubUsername(token.AccessToken)
 	if err != nil {
 		client.EnqueueMessage(SystemMessage(fmt.Sprintf("GitHub auth error: could not fetch user info: %v", err)))
+		auditAuthFailed(client, err)
 		return
 	}
 
@@ -58,6 +96,13 @@ func handleAuthentication(client *Client, cfg *Config) {
 	client.hub.requestNameChange(client, username, true)
 }
 
+// auditAuthFailed records a failed /gh attempt.
+func auditAuthFailed(client *Client, err error) {
+	entry := sessionEntry(auditAuthFailure, client)
+	entry.Error = err.Error()
+	client.hub.auditLog().record(entry)
+}
+
 // Calling API by using the token to get actual username
 func getGitHubUsername(token string) (string, error) {
 	client := &http.Client{Timeout: 10 * time.Second}
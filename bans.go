@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BanList holds the bans in force on this server and keeps them in a JSON
+// file next to the config, so they survive restarts. The hub adds and lifts
+// bans; SSH sessions are checked against it before the chat starts.
+type BanList struct {
+	mu   sync.Mutex
+	path string // "" keeps the list in memory only
+	bans []moderationAction
+}
+
+// loadBanList reads the ban list at path. A missing file is an empty list.
+func loadBanList(path string) (*BanList, error) {
+	b := &BanList{path: path}
+	if path == "" {
+		return b, nil
+	}
+	data, err := readFileWithRoot(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return b, nil
+	}
+	if err := json.Unmarshal(data, &b.bans); err != nil {
+		return nil, fmt.Errorf("parse ban list %s: %w", path, err)
+	}
+	for _, ban := range b.bans {
+		if ban.Network != "" {
+			if _, err := netip.ParsePrefix(ban.Network); err != nil {
+				return nil, fmt.Errorf("invalid network %q in ban list %s: %w", ban.Network, path, err)
+			}
+		}
+	}
+	return b, nil
+}
+
+// add records ban, replacing an earlier ban on the same identities, and
+// saves the list.
+func (b *BanList) add(ban moderationAction) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	kept := b.bans[:0]
+	for _, existing := range b.bans {
+		if !existing.sameTarget(ban) && !existing.expired(now) {
+			kept = append(kept, existing)
+		}
+	}
+	b.bans = append(kept, ban)
+	return b.saveLocked()
+}
+
+// remove lifts every ban on target, which may be a GitHub login, a key
+// fingerprint or an IP address or range, and returns how many there were.
+func (b *BanList) remove(target string) (int, error) {
+	if target == "" {
+		return 0, nil
+	}
+	network, isNetwork := parseBanNetwork(target)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := b.bans[:0]
+	removed := 0
+	for _, ban := range b.bans {
+		if strings.EqualFold(ban.Login, target) || ban.Fingerprint == target || (isNetwork && ban.Network == network) {
+			removed++
+			continue
+		}
+		kept = append(kept, ban)
+	}
+	b.bans = kept
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, b.saveLocked()
+}
+
+// find returns an active ban matching any of the given identities. Pass ""
+// for a login the user has not proved, and the zero Addr for no address.
+func (b *BanList) find(login, fingerprint string, addr netip.Addr) (moderationAction, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for _, ban := range b.bans {
+		if !ban.expired(now) && ban.matchesIdentity(login, fingerprint, addr) {
+			return ban, true
+		}
+	}
+	return moderationAction{}, false
+}
+
+// forClient returns an active ban on c.
+func (b *BanList) forClient(c *Client) (moderationAction, bool) {
+	login := ""
+	if c.IsAuthed() {
+		login = c.User()
+	}
+	return b.find(login, c.KeyFingerprint(), c.RemoteAddr())
+}
+
+// active returns the bans that have not expired.
+func (b *BanList) active() []moderationAction {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var bans []moderationAction
+	for _, ban := range b.bans {
+		if !ban.expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+func (b *BanList) saveLocked() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(b.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileWithRoot(b.path, append(data, '\n'), 0600)
+}
+
+// parseBanNetwork accepts an IP address or CIDR range and returns it as a
+// prefix, so 192.0.2.7 and 192.0.2.7/32 are the same ban.
+func parseBanNetwork(s string) (string, bool) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked().String(), true
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", false
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()).String(), true
+}
+
+// remoteIP extracts the IP from a connection's remote address.
+func remoteIP(addr net.Addr) netip.Addr {
+	if addr == nil {
+		return netip.Addr{}
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
+// describeBan is one line of /bans output.
+func describeBan(ban moderationAction) string {
+	var targets []string
+	for _, target := range []string{ban.Login, ban.Fingerprint, ban.Network} {
+		if target != "" {
+			targets = append(targets, target)
+		}
+	}
+	text := fmt.Sprintf("%s by %s", strings.Join(targets, " "), ban.Issuer)
+	if ban.Server != "" {
+		text += "@" + ban.Server
+	}
+	if ban.Expires.IsZero() {
+		text += ", permanent"
+	} else {
+		text += ", until " + ban.Expires.UTC().Format(time.RFC3339)
+	}
+	if ban.Reason != "" {
+		text += ": " + ban.Reason
+	}
+	return text
+}
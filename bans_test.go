@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanListPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	bans, err := loadBanList(path)
+	if err != nil {
+		t.Fatalf("loadBanList(missing) error: %v", err)
+	}
+
+	for _, ban := range []moderationAction{
+		{ID: "1", Action: moderationBan, Issuer: "mod", Login: "Troll", Reason: "spam"},
+		{ID: "2", Action: moderationBan, Issuer: "mod", Fingerprint: "SHA256:troll", Expires: time.Now().Add(time.Hour)},
+		{ID: "3", Action: moderationBan, Issuer: "mod", Network: "192.0.2.0/24"},
+		{ID: "4", Action: moderationBan, Issuer: "mod", Login: "gone", Expires: time.Now().Add(-time.Hour)},
+	} {
+		if err := bans.add(ban); err != nil {
+			t.Fatalf("add error: %v", err)
+		}
+	}
+
+	loaded, err := loadBanList(path)
+	if err != nil {
+		t.Fatalf("loadBanList error: %v", err)
+	}
+	if got := len(loaded.active()); got != 3 {
+		t.Fatalf("loaded %d active bans, want 3", got)
+	}
+	if ban, ok := loaded.find("troll", "", netip.Addr{}); !ok || ban.Reason != "spam" {
+		t.Fatalf("login ban not found after reload: %+v", ban)
+	}
+	if _, ok := loaded.find("", "SHA256:troll", netip.Addr{}); !ok {
+		t.Fatal("fingerprint ban not found after reload")
+	}
+	if _, ok := loaded.find("", "", netip.MustParseAddr("192.0.2.77")); !ok {
+		t.Fatal("an address inside a banned range should match")
+	}
+	if _, ok := loaded.find("", "", netip.MustParseAddr("::ffff:192.0.2.77")); !ok {
+		t.Fatal("an IPv4-mapped address should match an IPv4 range")
+	}
+	if _, ok := loaded.find("gone", "SHA256:other", netip.MustParseAddr("198.51.100.1")); ok {
+		t.Fatal("expired bans and other identities must not match")
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "0001-01-01") {
+		t.Fatalf("permanent bans should not store a zero expiry: %s", data)
+	}
+
+	if removed, err := loaded.remove("192.0.2.0/24"); err != nil || removed != 1 {
+		t.Fatalf("remove(range) = %d, %v", removed, err)
+	}
+	if removed, _ := loaded.remove("TROLL"); removed != 1 {
+		t.Fatalf("remove(login) = %d, want logins to match case-insensitively", removed)
+	}
+	if removed, _ := loaded.remove(""); removed != 0 {
+		t.Fatal("an empty target must not lift anything")
+	}
+	reloaded, _ := loadBanList(path)
+	if got := len(reloaded.active()); got != 1 {
+		t.Fatalf("%d bans left on disk, want only the fingerprint ban", got)
+	}
+}
+
+func TestLoadBanListRejectsBadNetworks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	if err := os.WriteFile(path, []byte(`[{"id":"1","action":"ban","issuer":"mod","network":"not-an-ip"}]`), 0600); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+	if _, err := loadBanList(path); err == nil {
+		t.Fatal("loadBanList should reject an invalid network")
+	}
+}
+
+func TestParseBanNetwork(t *testing.T) {
+	for input, want := range map[string]string{
+		"192.0.2.7":        "192.0.2.7/32",
+		"192.0.2.7/24":     "192.0.2.0/24",
+		"::ffff:192.0.2.7": "192.0.2.7/32",
+		"2001:db8::1":      "2001:db8::1/128",
+	} {
+		if got, ok := parseBanNetwork(input); !ok || got != want {
+			t.Fatalf("parseBanNetwork(%q) = %q, %v; want %q", input, got, ok, want)
+		}
+	}
+	if _, ok := parseBanNetwork("alice"); ok {
+		t.Fatal("a nick is not a network")
+	}
+	if got := remoteIP(&net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 5000}); got != netip.MustParseAddr("203.0.113.9") {
+		t.Fatalf("remoteIP = %v", got)
+	}
+}
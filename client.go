@@ -1,19 +1,24 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"log"
+	"net/netip"
 	"sync"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
 )
 
 type Client struct {
 	hub             *Hub
 	user            string // Username
 	isAuthed        bool   // True if authenticated via GitHub
+	room            string // Current chat room
+	nickClock       uint64 // Lamport timestamp of the claim on the current name
 	session         ssh.Session
 	input           io.Reader
 	output          io.Writer
@@ -21,6 +26,11 @@ type Client struct {
 	program         *tea.Program // BubbleTea instance.
 	authInProgress  bool
 	lastAuthAttempt time.Time
+	fingerprint     string       // SHA256 fingerprint of the user's SSH key, "" without one; fixed by NewClient
+	addr            netip.Addr   // Address the session connected from
+	role            string       // Granted after GitHub auth, "" for regular users
+	limiter         *rateLimiter // nil for no rate limits
+	kickReason      string       // Set once the user is disconnected by moderation
 	mu              sync.RWMutex
 }
 
@@ -32,14 +42,47 @@ func NewClient(session ssh.Session, hub *Hub, user string, input io.Reader, outp
 		output = session
 	}
 
+	fingerprint := ""
+	var addr netip.Addr
+	if session != nil {
+		if session.PublicKey() != nil {
+			fingerprint = cryptossh.FingerprintSHA256(session.PublicKey())
+		}
+		addr = remoteIP(session.RemoteAddr())
+	}
+
 	return &Client{
-		hub:      hub,
-		user:     user,
-		isAuthed: false, // Users start as anonymous
-		session:  session,
-		input:    input,
-		output:   output,
-		send:     make(chan Message, 256),
+		hub:         hub,
+		user:        user,
+		isAuthed:    false, // Users start as anonymous
+		session:     session,
+		input:       input,
+		output:      output,
+		send:        make(chan Message, 256),
+		fingerprint: fingerprint,
+		addr:        addr,
+	}
+}
+
+// KeyFingerprint returns the fingerprint of the key the user logged in with.
+func (c *Client) KeyFingerprint() string {
+	return c.fingerprint
+}
+
+// RemoteAddr returns the IP the user connected from, or the zero Addr.
+func (c *Client) RemoteAddr() netip.Addr {
+	return c.addr
+}
+
+// Disconnect ends the user's session; reason is shown once the chat view
+// has closed. It never blocks, so the hub can call it.
+func (c *Client) Disconnect(reason string) {
+	c.mu.Lock()
+	c.kickReason = reason
+	program := c.program
+	c.mu.Unlock()
+	if program != nil {
+		go program.Quit()
 	}
 }
 
@@ -61,25 +104,86 @@ func (c *Client) IsAuthed() bool {
 	return c.isAuthed
 }
 
+// SetIsAuthed updates the auth status. Losing it also drops any role, which
+// is tied to the GitHub login.
 func (c *Client) SetIsAuthed(isAuthed bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.isAuthed = isAuthed
+	if !isAuthed {
+		c.role = ""
+	}
+}
+
+func (c *Client) Role() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.role
+}
+
+func (c *Client) SetRole(role string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.role = role
+}
+
+func (c *Client) NickClock() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nickClock
+}
+
+func (c *Client) SetNickClock(clock uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nickClock = clock
+}
+
+// AuthProvider names the provider that verified the user's name, or returns
+// "" for anonymous users.
+func (c *Client) AuthProvider() string {
+	if !c.IsAuthed() {
+		return ""
+	}
+	return authProviderGitHub
+}
+
+func (c *Client) Room() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.room
+}
+
+func (c *Client) SetRoom(room string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.room = room
 }
 
 func (c *Client) RunTUI(width, height int, welcomeMsg string, cfg *Config) {
 	model := initialModel(c, width, height, welcomeMsg, cfg)
+	c.mu.Lock()
 	c.program = tea.NewProgram(
 		model,
 		tea.WithInput(c.input),
 		tea.WithOutput(c.output),
 		tea.WithAltScreen(),
 	)
+	kicked := c.kickReason != ""
+	c.mu.Unlock()
 
-	go c.writePump()
+	if !kicked {
+		go c.writePump()
+		if _, err := c.program.Run(); err != nil {
+			log.Printf("Error running TUI for %s: %v", c.User(), err)
+		}
+	}
 
-	if _, err := c.program.Run(); err != nil {
-		log.Printf("Error running TUI for %s: %v", c.User(), err)
+	c.mu.RLock()
+	reason := c.kickReason
+	c.mu.RUnlock()
+	if reason != "" {
+		fmt.Fprintf(c.output, "\r\n%s\r\n", sanitizeForTerminal(reason))
 	}
 
 	if closer, ok := c.output.(io.Closer); ok {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -25,6 +26,34 @@ func TestClientStartAuthAttemptCooldown(t *testing.T) {
 	}
 }
 
+func TestParseModerationCommand(t *testing.T) {
+	c := &Client{user: "mod"}
+
+	req, usage := parseModerationCommand(c, "/ban", []string{"bob@beta", "7d", "spam", "links"})
+	if usage != "" || req.target != "bob" || req.server != "beta" || req.duration != 7*24*time.Hour || req.reason != "spam links" {
+		t.Fatalf("/ban = %+v, %q", req, usage)
+	}
+	req, _ = parseModerationCommand(c, "/ban", []string{"bob", "for", "spam"})
+	if req.duration != 0 || req.reason != "for spam" {
+		t.Fatalf("/ban without a duration = %+v, want a permanent ban", req)
+	}
+	req, _ = parseModerationCommand(c, "/kick", []string{"bob", "10m"})
+	if req.duration != 0 || req.reason != "10m" {
+		t.Fatalf("/kick = %+v, want no duration", req)
+	}
+	if _, usage := parseModerationCommand(c, "/mute", []string{"bob", "soon"}); usage == "" {
+		t.Fatal("/mute without a duration should print usage")
+	}
+	if _, usage := parseModerationCommand(c, "/kick", nil); usage == "" {
+		t.Fatal("/kick without a target should print usage")
+	}
+	for _, bad := range []string{"0d", "-5m", "xd", "abc"} {
+		if _, ok := parseModerationDuration(bad); ok {
+			t.Fatalf("parseModerationDuration(%q) should fail", bad)
+		}
+	}
+}
+
 func TestHandleCommandBasicCases(t *testing.T) {
 	h := &Hub{
 		changeName:   make(chan nameChangeRequest, 1),
@@ -62,3 +91,62 @@ func TestHandleCommandBasicCases(t *testing.T) {
 		t.Fatal("/w with missing text should return usage system message")
 	}
 }
+
+func TestBanListCommands(t *testing.T) {
+	h := newHub()
+	_ = h.bans.add(moderationAction{ID: "1", Action: moderationBan, Issuer: "mod", Login: "troll", Reason: "spam"})
+	user := &Client{hub: h, user: "bob"}
+	mod := &Client{hub: h, user: "mod", isAuthed: true, role: roleModerator}
+
+	if msg, _ := handleCommand(user, "/unban troll", nil); msg.Content != "Only moderators can lift bans." {
+		t.Fatalf("/unban by a regular user = %q", msg.Content)
+	}
+	if msg, _ := handleCommand(mod, "/bans", nil); msg.Content != "Active bans (1):\n1: troll by mod, permanent: spam" {
+		t.Fatalf("/bans = %q", msg.Content)
+	}
+	if msg, _ := handleCommand(mod, "/unban troll", nil); msg.Content != "Lifted 1 ban(s) on troll." {
+		t.Fatalf("/unban = %q", msg.Content)
+	}
+	if msg, _ := handleCommand(mod, "/unban troll", nil); msg.Content != "No ban on troll." {
+		t.Fatalf("second /unban = %q", msg.Content)
+	}
+}
+
+func TestAnonymousPolicy(t *testing.T) {
+	anon := &Client{user: "Anonymous1234"}
+	authed := &Client{user: "octocat", isAuthed: true}
+
+	cases := []struct {
+		client  *Client
+		policy  string
+		command string
+		allowed bool
+	}{
+		{anon, anonymousAllowed, "", true},
+		{anon, anonymousAllowed, "/w", true},
+		{anon, anonymousReadOnly, "", false},
+		{anon, anonymousReadOnly, "/w", false},
+		{anon, anonymousReadOnly, "/n", false},
+		{anon, anonymousReadOnly, "/u", true},
+		{anon, anonymousReadOnly, "/j", true},
+		{anon, anonymousBlocked, "/u", false},
+		{anon, anonymousBlocked, "/gh", true},
+		{authed, anonymousBlocked, "", true},
+		{authed, anonymousBlocked, "/w", true},
+	}
+	for _, tc := range cases {
+		refusal := anonymousRefusal(tc.client, tc.policy, tc.command)
+		if (refusal == "") != tc.allowed {
+			t.Fatalf("anonymousRefusal(%s, %s, %q) = %q, want allowed=%v", tc.client.user, tc.policy, tc.command, refusal, tc.allowed)
+		}
+	}
+
+	cfg := &Config{}
+	cfg.Chat.Anonymous = anonymousReadOnly
+	if msg, handled := handleCommand(anon, "/w octocat hi", cfg); !handled || msg.Content != "Anonymous users cannot use /w here. Use /gh to authenticate with GitHub first." {
+		t.Fatalf("/w by an anonymous user = %q", msg.Content)
+	}
+	if msg, _ := handleCommand(authed, "/n someone", cfg); !strings.Contains(msg.Content, "drop your GitHub authentication") {
+		t.Fatalf("/n by an authenticated user = %q, want a refusal", msg.Content)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,15 +16,28 @@ func handleCommand(c *Client, input string, cfg *Config) (Message, bool) {
 	command := parts[0]
 	var responseMsg Message
 
+	if refusal := anonymousRefusal(c, cfg.anonymousPolicy(), command); refusal != "" {
+		return SystemMessage(refusal), true
+	}
+
 	switch command {
 	case "/h":
 		helpMsg := "Available commands:\n" +
 			"  /h                    - Show this help message\n" +
 			"  /u                    - List users in the chat\n" +
 			"  /n <name>             - Change your name\n" +
-			"  /w <user> <message>   - Send a private message\n" +
+			"  /w <user> <message>   - Send a private message (user or user@server)\n" +
+			"  /j <room>             - Join a room (e.g. /j #ops)\n" +
+			"  /l                    - Leave the current room and return to " + defaultRoom + "\n" +
+			"  /rooms                - List active rooms\n" +
 			"  /gh                   - Authenticate with GitHub to get your GitHub name\n" +
-			"  /s                    - List connected servers"
+			"  /s                    - List connected servers\n" +
+			"  /fed <command>        - Manage federation peers (admins only, /fed for usage)\n" +
+			"  /kick <user> [reason] - Disconnect a user (moderators)\n" +
+			"  /mute <user> <time> [reason] - Silence a user, e.g. /mute bob 10m (moderators)\n" +
+			"  /ban <user|ip|cidr> [time] [reason] - Ban a user's GitHub login and key, or an address (moderators)\n" +
+			"  /unban <login|fingerprint|ip|cidr>  - Lift bans (moderators)\n" +
+			"  /bans                 - List active bans (moderators)"
 		responseMsg = SystemMessage(helpMsg)
 
 	case "/u":
@@ -33,15 +47,69 @@ func handleCommand(c *Client, input string, cfg *Config) (Message, bool) {
 
 	case "/s":
 		var serverList []string
-		for i, s := range c.hub.federation.servers {
-			serverList = append(serverList, fmt.Sprintf("%d: %s", i+1, s.addr))
+		for i, s := range c.hub.federation.Peers() {
+			serverList = append(serverList, fmt.Sprintf("%d: %s - %s", i+1, s.addr, formatLinkStatus(s.Status())))
 		}
 		serverListMsg := fmt.Sprintf("Connected servers (%d):\n%s", len(serverList), strings.Join(serverList, "\n"))
 		responseMsg = SystemMessage(serverListMsg)
 
+	case "/fed":
+		if !isAdmin(c) {
+			responseMsg = SystemMessage("Only admins can manage federation peers.")
+		} else {
+			responseMsg = SystemMessage(runFederationCommand(c.hub.federation, cfg, c.User(), "/fed", parts[1:]))
+		}
+
+	case "/kick", "/mute", "/ban":
+		req, usage := parseModerationCommand(c, command, parts[1:])
+		if usage != "" {
+			responseMsg = SystemMessage(usage)
+		} else {
+			c.hub.requestModeration(req)
+			return Message{}, true
+		}
+
+	case "/unban":
+		if !isModerator(c) {
+			responseMsg = SystemMessage("Only moderators can lift bans.")
+		} else if len(parts) != 2 {
+			responseMsg = SystemMessage("Usage: /unban <login|fingerprint|ip|cidr>")
+		} else {
+			removed, err := c.hub.bans.remove(parts[1])
+			if removed > 0 {
+				// The bans are lifted in memory even if saving them failed.
+				entry := unbanEntry(c.User(), parts[1])
+				if err != nil {
+					entry.Error = err.Error()
+				}
+				c.hub.auditLog().record(entry)
+			}
+			if err != nil {
+				responseMsg = SystemMessage(fmt.Sprintf("Lifted the ban on %s, but saving the ban list failed: %v", parts[1], err))
+			} else if removed == 0 {
+				responseMsg = SystemMessage(fmt.Sprintf("No ban on %s.", parts[1]))
+			} else {
+				responseMsg = SystemMessage(fmt.Sprintf("Lifted %d ban(s) on %s.", removed, parts[1]))
+			}
+		}
+
+	case "/bans":
+		if !isModerator(c) {
+			responseMsg = SystemMessage("Only moderators can list bans.")
+		} else {
+			bans := c.hub.bans.active()
+			lines := make([]string, 0, len(bans))
+			for i, ban := range bans {
+				lines = append(lines, fmt.Sprintf("%d: %s", i+1, describeBan(ban)))
+			}
+			responseMsg = SystemMessage(fmt.Sprintf("Active bans (%d):\n%s", len(lines), strings.Join(lines, "\n")))
+		}
+
 	case "/n":
 		if len(parts) < 2 {
 			responseMsg = SystemMessage("Usage: /n <newname>")
+		} else if c.IsAuthed() && cfg.anonymousPolicy() != anonymousAllowed {
+			responseMsg = SystemMessage("Renaming would drop your GitHub authentication, which this server requires. Your name stays your GitHub login.")
 		} else {
 			newName := normalizeUsername(parts[1])
 			if !isValidUsername(newName) {
@@ -72,16 +140,48 @@ func handleCommand(c *Client, input string, cfg *Config) (Message, bool) {
 		if len(parts) < 3 {
 			responseMsg = SystemMessage("Usage: /w <username> <message>")
 		} else {
-			targetUser := normalizeUsername(parts[1])
+			targetUser, targetServer := splitUserAddress(parts[1])
+			if strings.Contains(parts[1], "@") && !isValidServerName(targetServer) {
+				responseMsg = SystemMessage("Invalid server name. Use /w <user>@<server> <message>.")
+				break
+			}
 			content := strings.Join(parts[2:], " ")
 			msg := Message{
-				Author:  c.User(),
-				Content: content,
+				Author:         c.User(),
+				Content:        content,
+				AuthorIsAuthed: c.IsAuthed(),
+				AuthProvider:   c.AuthProvider(),
 			}
-			c.hub.sendPrivateMessage(targetUser, msg, c)
+			c.hub.sendPrivateMessage(targetUser, targetServer, msg, c)
+			return Message{}, true
+		}
+
+	case "/j":
+		if len(parts) < 2 {
+			responseMsg = SystemMessage("Usage: /j <room>")
+		} else if !isValidRoomName(parts[1]) {
+			responseMsg = SystemMessage("Invalid room name. Use 2-20 characters: letters/digits from any language, '_' or '-'.")
+		} else {
+			c.hub.requestRoomChange(c, parts[1])
+			return Message{}, true
+		}
+
+	case "/l":
+		if c.Room() == defaultRoom {
+			responseMsg = SystemMessage(fmt.Sprintf("You are already in %s.", defaultRoom))
+		} else {
+			c.hub.requestRoomChange(c, defaultRoom)
 			return Message{}, true
 		}
 
+	case "/rooms":
+		rooms := c.hub.getRoomList()
+		var roomList []string
+		for _, r := range rooms {
+			roomList = append(roomList, fmt.Sprintf("%s (%d)", r.Name, r.Members))
+		}
+		responseMsg = SystemMessage(fmt.Sprintf("Active rooms (%d): %s", len(roomList), strings.Join(roomList, ", ")))
+
 	default:
 		responseMsg = SystemMessage(fmt.Sprintf("Unknown command: %s", command))
 	}
@@ -89,6 +189,92 @@ func handleCommand(c *Client, input string, cfg *Config) (Message, bool) {
 	return responseMsg, true
 }
 
+// parseModerationCommand turns /kick, /mute or /ban arguments into a request
+// for the hub, or returns a usage message.
+func parseModerationCommand(c *Client, command string, args []string) (moderationRequest, string) {
+	action := strings.TrimPrefix(command, "/")
+	usage := map[string]string{
+		moderationKick: "Usage: /kick <user> [reason]",
+		moderationMute: "Usage: /mute <user> <duration> [reason], e.g. /mute bob 10m",
+		moderationBan:  "Usage: /ban <user|ip|cidr> [duration] [reason], e.g. /ban bob 7d spam",
+	}[action]
+	if len(args) < 1 {
+		return moderationRequest{}, usage
+	}
+
+	target, server := splitUserAddress(args[0])
+	req := moderationRequest{issuer: c, action: action, target: target, server: server}
+	rest := args[1:]
+	if action != moderationKick && len(rest) > 0 {
+		if d, ok := parseModerationDuration(rest[0]); ok {
+			req.duration = d
+			rest = rest[1:]
+		}
+	}
+	if action == moderationMute && req.duration == 0 {
+		return moderationRequest{}, usage
+	}
+	req.reason = strings.Join(rest, " ")
+	return req, ""
+}
+
+// parseModerationDuration accepts Go durations such as 90s or 12h, and whole
+// days such as 7d.
+func parseModerationDuration(s string) (time.Duration, bool) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, false
+		}
+		return time.Duration(n) * 24 * time.Hour, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// isAdmin reports whether c authenticated with GitHub as a login listed in
+// [admins] users.
+func isAdmin(c *Client) bool {
+	return c.IsAuthed() && c.Role() == roleAdmin
+}
+
+// isModerator reports whether c holds the moderator role or a higher one.
+func isModerator(c *Client) bool {
+	return c.IsAuthed() && roleRank(c.Role()) >= roleRank(roleModerator)
+}
+
+func formatLinkStatus(status linkStatus) string {
+	details := status.State
+	if status.Peer != nil {
+		details = fmt.Sprintf("%s, SoftRoom %s (protocol %d)", status.State, status.Peer.SoftwareVersion, status.Peer.ProtocolVersion)
+		if status.Peer.ServerName != "" {
+			details = fmt.Sprintf("%s as %s", details, status.Peer.ServerName)
+		}
+		if status.RTT > 0 {
+			details += fmt.Sprintf(", rtt %s", status.RTT.Round(time.Millisecond))
+		}
+		if !status.LastSeen.IsZero() {
+			details += fmt.Sprintf(", last seen %s ago", time.Since(status.LastSeen).Round(time.Second))
+		}
+		if status.Queued > 0 {
+			details += fmt.Sprintf(", queue %d/%d", status.Queued, status.QueueSize)
+		}
+	} else if status.State == linkBackingOff && !status.NextRetry.IsZero() {
+		wait := time.Until(status.NextRetry).Round(time.Second)
+		if wait < 0 {
+			wait = 0
+		}
+		details = fmt.Sprintf("%s (next retry in %s)", status.State, wait)
+	}
+	if status.Dropped > 0 {
+		details += fmt.Sprintf(", %d frames dropped, %d overflow resets", status.Dropped, status.Disconnects)
+	}
+	return details
+}
+
 func SystemMessage(content string) Message {
 	return Message{
 		Author:  "System",
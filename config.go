@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/pem"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/ssh"
 	cryptossh "golang.org/x/crypto/ssh"
@@ -27,13 +29,148 @@ type Config struct {
 		ClientID string `ini:"client_id"`
 	} `ini:"github_auth"`
 	Chat struct {
-		WelcomeMessage string `ini:"welcome_message"`
+		WelcomeMessage  string `ini:"welcome_message"`
+		ShowServerNames bool   `ini:"show_server_names"`
+		Anonymous       string `ini:"anonymous"` // allowed, read-only or blocked
 	} `ini:"chat"`
-	Federation struct {
-		Servers        []string `ini:"servers,omitempty,allowshadow"`
-		KnownHostsPath string   `ini:"known_hosts_path"`
-		SharedSecret   string   `ini:"shared_secret"`
-	} `ini:"federation"`
+	Federation FederationConfig `ini:"federation"`
+	Admins     struct {
+		Users []string `ini:"users,omitempty,allowshadow"` // GitHub logins
+		Keys  []string `ini:"keys,omitempty,allowshadow"`  // authorized_keys lines for the control interface
+	} `ini:"admins"`
+	Moderators struct {
+		Users []string `ini:"users,omitempty,allowshadow"` // GitHub logins
+	} `ini:"moderators"`
+	Bans struct {
+		Path string `ini:"path"`
+	} `ini:"bans"`
+	Limits LimitsConfig `ini:"limits"`
+	Audit  struct {
+		Path      string `ini:"path"` // "" turns the audit log off
+		MaxSizeMB int    `ini:"max_size_mb"`
+		Keep      int    `ini:"keep"`
+	} `ini:"audit"`
+
+	path      string // File the config was loaded from, for `fed save`
+	adminKeys []cryptossh.PublicKey
+}
+
+// roles maps the lowercased GitHub logins in [moderators] and [admins] to
+// their role. A login in both lists is an admin.
+func (cfg *Config) roles() map[string]string {
+	roles := make(map[string]string)
+	if cfg == nil {
+		return roles
+	}
+	for _, login := range cfg.Moderators.Users {
+		roles[strings.ToLower(strings.TrimSpace(login))] = roleModerator
+	}
+	for _, login := range cfg.Admins.Users {
+		roles[strings.ToLower(strings.TrimSpace(login))] = roleAdmin
+	}
+	delete(roles, "")
+	return roles
+}
+
+// anonymousPolicy returns the [chat] anonymous setting; without a config
+// anonymous users are allowed.
+func (cfg *Config) anonymousPolicy() string {
+	if cfg == nil || cfg.Chat.Anonymous == "" {
+		return anonymousAllowed
+	}
+	return cfg.Chat.Anonymous
+}
+
+// isAdminKey reports whether key is listed in [admins] keys.
+func (cfg *Config) isAdminKey(key ssh.PublicKey) bool {
+	if cfg == nil || key == nil {
+		return false
+	}
+	for _, admin := range cfg.adminKeys {
+		if ssh.KeysEqual(admin, key) {
+			return true
+		}
+	}
+	return false
+}
+
+type FederationConfig struct {
+	ServerName        string        `ini:"server_name"`
+	Servers           []string      `ini:"servers,omitempty,allowshadow"`
+	KnownHostsPath    string        `ini:"known_hosts_path"`
+	SharedSecret      string        `ini:"shared_secret"`
+	PeerSecrets       []string      `ini:"peer_secrets,omitempty,allowshadow"`
+	PeerKeys          []string      `ini:"peer_keys,omitempty,allowshadow"`
+	Disabled          []string      `ini:"disabled,omitempty,allowshadow"` // Peers kept configured but not connected
+	ReconnectMaxDelay time.Duration `ini:"reconnect_max_delay"`
+	HeartbeatInterval time.Duration `ini:"heartbeat_interval"`
+	HeartbeatMisses   int           `ini:"heartbeat_missed"`
+	OutboundQueueSize int           `ini:"outbound_queue_size"`
+	TrustOnFirstUse   bool          `ini:"trust_on_first_use"`
+	ModerationTrust   []string      `ini:"moderation_trust,omitempty,allowshadow"`
+}
+
+// secretFor returns the per-peer secret for addr, falling back to the shared one.
+func (fc FederationConfig) secretFor(addr string) (string, error) {
+	secrets, err := parsePeerMap(fc.PeerSecrets, "peer_secrets")
+	if err != nil {
+		return "", err
+	}
+	if secret, ok := secrets[addr]; ok {
+		return secret, nil
+	}
+	return strings.TrimSpace(fc.SharedSecret), nil
+}
+
+// moderationTrust parses the moderation_trust entries, keyed by peer address.
+func (fc FederationConfig) moderationTrust() (map[string]string, error) {
+	trust, err := parsePeerMap(fc.ModerationTrust, "moderation_trust")
+	if err != nil {
+		return nil, err
+	}
+	for addr, level := range trust {
+		if _, ok := moderationLevels[level]; !ok {
+			return nil, fmt.Errorf("invalid `moderation_trust` level %q for %s, expected none, kick, mute or ban", level, addr)
+		}
+	}
+	return trust, nil
+}
+
+// parsePeerKeys parses "host:port=<authorized_keys line>" entries.
+func parsePeerKeys(entries []string) (map[string]cryptossh.PublicKey, error) {
+	raw, err := parsePeerMap(entries, "peer_keys")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]cryptossh.PublicKey, len(raw))
+	for addr, line := range raw {
+		key, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid `peer_keys` entry for %s: %w", addr, err)
+		}
+		keys[addr] = key
+	}
+	return keys, nil
+}
+
+// parsePeerMap parses "host:port=value" entries into a map keyed by peer address.
+func parsePeerMap(entries []string, field string) (map[string]string, error) {
+	result := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		addr, value, ok := strings.Cut(entry, "=")
+		addr = strings.TrimSpace(addr)
+		value = strings.TrimSpace(value)
+		if !ok || addr == "" || value == "" {
+			return nil, fmt.Errorf("invalid `%s` entry %q, expected host:port=value", field, entry)
+		}
+		result[addr] = value
+	}
+	return result, nil
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -43,7 +180,29 @@ func LoadConfig(path string) (*Config, error) {
 	cfg.Server.Port = 2222
 	cfg.Server.HostKeyPath = "./id_rsa"
 	cfg.Chat.WelcomeMessage = "Welcome to SoftRoom!"
+	cfg.Chat.Anonymous = anonymousAllowed
 	cfg.Federation.KnownHostsPath = "./federation_known_hosts"
+	cfg.Bans.Path = "./bans.json"
+	cfg.Audit.Path = "./audit.log"
+	cfg.Audit.MaxSizeMB = defaultAuditMaxSizeMB
+	cfg.Audit.Keep = defaultAuditKeep
+	cfg.Limits = LimitsConfig{
+		MessageInterval:    defaultMessageInterval,
+		MessageBurst:       defaultMessageBurst,
+		CommandInterval:    defaultCommandInterval,
+		CommandBurst:       defaultCommandBurst,
+		PrivateInterval:    defaultPrivateInterval,
+		PrivateBurst:       defaultPrivateBurst,
+		NameChangeInterval: defaultNameChangeInterval,
+		NameChangeBurst:    defaultNameChangeBurst,
+		MuteAfter:          defaultFloodMuteAfter,
+		MuteWindow:         defaultFloodMuteWindow,
+		MuteDuration:       defaultFloodMuteDuration,
+	}
+	cfg.Federation.ReconnectMaxDelay = defaultFederationReconnectDelay
+	cfg.Federation.HeartbeatInterval = defaultHeartbeatInterval
+	cfg.Federation.HeartbeatMisses = defaultHeartbeatMisses
+	cfg.Federation.OutboundQueueSize = defaultOutboundQueueSize
 
 	// MapTo will load the file and override defaults
 	err := ini.MapTo(cfg, path)
@@ -55,13 +214,111 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("`client_id` in section `github_auth` must be set in %s", path)
 	}
 
-	if len(cfg.Federation.Servers) > 0 && strings.TrimSpace(cfg.Federation.SharedSecret) == "" {
-		return nil, fmt.Errorf("`shared_secret` in section `federation` must be set when federation servers are configured")
+	switch cfg.Chat.Anonymous {
+	case anonymousAllowed, anonymousReadOnly, anonymousBlocked:
+	default:
+		return nil, fmt.Errorf("`anonymous` in section `chat` must be allowed, read-only or blocked")
+	}
+
+	if cfg.Federation.ServerName != "" && !isValidServerName(cfg.Federation.ServerName) {
+		return nil, fmt.Errorf("`server_name` in section `federation` must be 1-32 characters: letters, digits, '-' or '.'")
 	}
 
+	if _, err := parsePeerKeys(cfg.Federation.PeerKeys); err != nil {
+		return nil, err
+	}
+
+	if _, err := cfg.Federation.moderationTrust(); err != nil {
+		return nil, err
+	}
+
+	for _, line := range cfg.Admins.Keys {
+		key, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid `keys` entry in section `admins`: %w", err)
+		}
+		cfg.adminKeys = append(cfg.adminKeys, key)
+	}
+
+	for _, addr := range cfg.Federation.Servers {
+		secret, err := cfg.Federation.secretFor(addr)
+		if err != nil {
+			return nil, err
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("`shared_secret` in section `federation` must be set when federation servers are configured (or set a `peer_secrets` entry for %s)", addr)
+		}
+	}
+
+	if cfg.Federation.ReconnectMaxDelay < federationInitialBackoff {
+		return nil, fmt.Errorf("`reconnect_max_delay` in section `federation` must be at least %s", federationInitialBackoff)
+	}
+
+	if cfg.Federation.HeartbeatInterval < time.Second {
+		return nil, fmt.Errorf("`heartbeat_interval` in section `federation` must be at least 1s")
+	}
+
+	if cfg.Federation.HeartbeatMisses < 1 {
+		return nil, fmt.Errorf("`heartbeat_missed` in section `federation` must be at least 1")
+	}
+
+	if cfg.Federation.OutboundQueueSize < 1 {
+		return nil, fmt.Errorf("`outbound_queue_size` in section `federation` must be at least 1")
+	}
+
+	if err := cfg.Limits.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Audit.MaxSizeMB < 1 {
+		return nil, fmt.Errorf("`max_size_mb` in section `audit` must be at least 1")
+	}
+
+	if cfg.Audit.Keep < 0 {
+		return nil, fmt.Errorf("`keep` in section `audit` cannot be negative")
+	}
+
+	cfg.path = path
 	return cfg, nil
 }
 
+// saveFederationPeers rewrites the peer lists in the [federation] section of
+// the ini file at path, leaving the other settings as they are.
+func saveFederationPeers(path string, fc FederationConfig) error {
+	data, err := readFileWithRoot(path)
+	if err != nil {
+		return err
+	}
+	file, err := ini.Load(data)
+	if err != nil {
+		return err
+	}
+
+	section := file.Section("federation")
+	for _, list := range []struct {
+		name   string
+		values []string
+	}{
+		{"servers", fc.Servers},
+		{"peer_secrets", fc.PeerSecrets},
+		{"peer_keys", fc.PeerKeys},
+		{"disabled", fc.Disabled},
+	} {
+		name, values := list.name, list.values
+		if len(values) == 0 {
+			section.DeleteKey(name)
+			continue
+		}
+		section.Key(name).SetValue(strings.Join(values, ", "))
+	}
+
+	var buf bytes.Buffer
+	if _, err := file.WriteTo(&buf); err != nil {
+		return err
+	}
+	return writeFileWithRoot(path, buf.Bytes(), 0600)
+}
+
 // CreateDefaultConfig creates a default softroom.ini file for the user
 func CreateDefaultConfig(path string) error {
 	content := `
@@ -84,14 +341,86 @@ client_id = YOUR_GITHUB_OAUTH_CLIENT_ID
 [chat]
 ; The message displayed to users after they successfully log in.
 welcome_message = Welcome to SoftRoom based group chat!
+; Show remote users as nick@server in /u and next to their messages.
+show_server_names = false
+; What users who have not authenticated with /gh may do: allowed (everything),
+; read-only (read, but not post or send private messages) or blocked (nothing
+; until they authenticate; they do not see the chat or appear in /u).
+anonymous = allowed
 
 [federation]
+; Name other servers use for this one, e.g. in nick@server. Defaults to the server ID.
+; server_name = example
 ; A list of other SoftRoom servers to connect to.
 ; servers = host:port, anotherhost:port
 ; Path to SSH known_hosts file for federation peers.
 known_hosts_path = ./federation_known_hosts
-; Shared secret used to authenticate federation messages between trusted servers.
+; Hold unknown peer host keys for admin approval (fed pending / fed approve)
+; instead of failing; approved keys are appended to known_hosts_path.
+trust_on_first_use = false
+; Shared secret used to authenticate federation links between trusted servers.
+; It is never sent over the wire; peers prove knowledge of it with an HMAC challenge-response.
 shared_secret = CHANGE_ME_TO_A_LONG_RANDOM_SECRET
+; Optional per-peer secrets that override shared_secret for a single peer.
+; peer_secrets = host:port=secret, anotherhost:port=othersecret
+; SSH public key of each peer (its host key), used to recognise inbound federation links.
+; peer_keys = host:port=ssh-ed25519 AAAA..., anotherhost:port=ssh-ed25519 AAAA...
+; Peers that stay configured but are not connected to (see /fed disable).
+; disabled = host:port
+; Upper bound for the exponential backoff between reconnect attempts to a peer.
+reconnect_max_delay = 5m
+; How often to ping each peer, and how many unanswered pings in a row close the link.
+heartbeat_interval = 15s
+heartbeat_missed = 3
+; Frames buffered per peer before messages are dropped or the link is reset.
+outbound_queue_size = 256
+; Which moderation actions signed by a peer are applied here: none (default),
+; kick, mute (kicks and mutes) or ban (everything).
+; moderation_trust = host:port=mute, anotherhost:port=ban
+
+[admins]
+; GitHub logins allowed to run admin commands such as /fed once authenticated with /gh.
+; users = octocat, hubot
+; SSH public keys allowed to run control commands, e.g. ssh -p 2299 host fed list
+; keys = ssh-ed25519 AAAA...
+
+[moderators]
+; GitHub logins allowed to use /kick, /mute and /ban once authenticated with /gh.
+; Admins can moderate too.
+; users = hubot
+
+[bans]
+; File the ban list is kept in. Bans are added with /ban and lifted with /unban.
+path = ./bans.json
+
+[limits]
+; Each user may send a burst of lines of each kind, then one more per interval.
+; Lines over the limit are dropped. An interval of 0 turns that limit off.
+message_interval = 1s
+message_burst = 5
+command_interval = 500ms
+command_burst = 10
+private_interval = 1s
+private_burst = 5
+; /n and /gh
+name_change_interval = 10s
+name_change_burst = 3
+; Users with mute_after dropped lines within mute_window are muted for
+; mute_duration on this server, by login and key, or for the session alone
+; if they have neither. 0 turns automatic mutes off.
+mute_after = 10
+mute_window = 1m
+mute_duration = 5m
+
+[audit]
+; Append-only JSON lines log of kicks, mutes, bans, GitHub logins, federation
+; auth failures and peer changes. It never contains chat messages.
+; Leave path empty to turn it off.
+path = ./audit.log
+; Rotate the log once it reaches this size, keeping this many old files
+; (audit.log.1 is the newest).
+max_size_mb = 10
+keep = 5
 `
 	return writeFileWithRoot(path, []byte(strings.TrimSpace(content)), 0600)
 }
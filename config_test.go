@@ -27,6 +27,20 @@ func TestLoadConfigSuccessAndValidation(t *testing.T) {
 	if cfg.Server.Port != 2222 {
 		t.Fatalf("default server port = %d, want 2222", cfg.Server.Port)
 	}
+	if cfg.Limits.MessageBurst != defaultMessageBurst || cfg.Limits.MuteAfter != defaultFloodMuteAfter {
+		t.Fatalf("default limits = %+v", cfg.Limits)
+	}
+	if cfg.anonymousPolicy() != anonymousAllowed {
+		t.Fatalf("default anonymous policy = %q, want allowed", cfg.anonymousPolicy())
+	}
+
+	policyPath := filepath.Join(dir, "policy.ini")
+	if err := os.WriteFile(policyPath, []byte(good+"[chat]\nanonymous = sometimes\n"), 0600); err != nil {
+		t.Fatalf("WriteFile policy.ini: %v", err)
+	}
+	if _, err := LoadConfig(policyPath); err == nil {
+		t.Fatal("LoadConfig should reject an unknown anonymous policy")
+	}
 
 	badPath := filepath.Join(dir, "bad.ini")
 	bad := "[server]\nport = 2222\n"
@@ -47,6 +61,20 @@ func TestLoadConfigSuccessAndValidation(t *testing.T) {
 	if _, err := LoadConfig(fedPath); err == nil {
 		t.Fatal("LoadConfig should fail when federation servers are set without shared_secret")
 	}
+
+	peerPath := filepath.Join(dir, "peer.ini")
+	peer := "[github_auth]\nclient_id = abc123\n[federation]\nservers = one:22\npeer_secrets = one:22=s3cret\n"
+	if err := os.WriteFile(peerPath, []byte(peer), 0600); err != nil {
+		t.Fatalf("WriteFile peer.ini: %v", err)
+	}
+
+	cfg, err = LoadConfig(peerPath)
+	if err != nil {
+		t.Fatalf("LoadConfig should accept a per-peer secret without shared_secret: %v", err)
+	}
+	if secret, _ := cfg.Federation.secretFor("one:22"); secret != "s3cret" {
+		t.Fatalf("secretFor(one:22) = %q, want s3cret", secret)
+	}
 }
 
 func TestCreateDefaultConfigAndRootFileHelpers(t *testing.T) {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -62,7 +63,7 @@ func TestHubHelperMethodsAndSendToClient(t *testing.T) {
 	h := &Hub{
 		clients:       make(map[*Client]bool),
 		clientsByName: make(map[string]*Client),
-		remoteNicks:   map[string][]string{"srv:22": {"remote_user"}},
+		remoteNicks:   map[string]map[string]nickRoute{"srv:22": {"remote_user": {Path: []string{"srv"}}}},
 	}
 
 	c := &Client{user: "alice", send: make(chan Message, 1)}
@@ -98,3 +99,203 @@ func TestHubHelperMethodsAndSendToClient(t *testing.T) {
 		t.Fatal("client should be removed from clientsByName after overflow handling")
 	}
 }
+
+func TestHubRoomMembershipAndScopedDelivery(t *testing.T) {
+	h := newHub()
+
+	alice := &Client{user: "alice", send: make(chan Message, 10)}
+	bob := &Client{user: "bob", send: make(chan Message, 10)}
+	for _, c := range []*Client{alice, bob} {
+		h.clients[c] = true
+		h.clientsByName[c.User()] = c
+		h.addToRoom(c, defaultRoom)
+	}
+
+	h.moveClientToRoom(alice, "#ops")
+	if alice.Room() != "#ops" {
+		t.Fatalf("alice room = %q, want #ops", alice.Room())
+	}
+	if len(bob.send) != 1 {
+		t.Fatalf("bob should see alice leaving the lobby, got %d messages", len(bob.send))
+	}
+	<-bob.send
+	if len(alice.send) != 1 {
+		t.Fatalf("alice should see her own join announcement, got %d messages", len(alice.send))
+	}
+	<-alice.send
+
+	h.deliverLocal(Message{Author: "bob", Content: "hi", Type: "public", Room: defaultRoom})
+	if len(alice.send) != 0 || len(bob.send) != 1 {
+		t.Fatalf("room delivery leaked: alice=%d bob=%d", len(alice.send), len(bob.send))
+	}
+	<-bob.send
+
+	h.deliverLocal(SystemMessage("global"))
+	if len(alice.send) != 1 || len(bob.send) != 1 {
+		t.Fatal("messages without a room should reach every client")
+	}
+
+	rooms := h.roomSummaries()
+	if len(rooms) != 2 || rooms[0].Name != "#lobby" || rooms[1].Name != "#ops" {
+		t.Fatalf("unexpected room summaries: %+v", rooms)
+	}
+
+	h.removeFromRoom(alice)
+	if _, exists := h.rooms["#ops"]; exists {
+		t.Fatal("empty rooms should be removed")
+	}
+}
+
+func TestHubAnnouncesJoinsAndLeavesToTheRoom(t *testing.T) {
+	h := newHub()
+	f, err := NewFederation(h, FederationConfig{}, nil)
+	if err != nil {
+		t.Fatalf("NewFederation error: %v", err)
+	}
+	h.federation = f
+	go h.run()
+
+	alice := &Client{user: "alice", send: make(chan Message, 10)}
+	h.register <- alice
+	if msg := <-alice.send; msg.Content != "alice has joined." {
+		t.Fatalf("alice got %q, want their own join notice", msg.Content)
+	}
+	h.requestRoomChange(alice, "#ops")
+	if msg := <-alice.send; msg.Content != "alice has joined #ops." {
+		t.Fatalf("alice got %q, want their room change", msg.Content)
+	}
+
+	bob := &Client{user: "bob", send: make(chan Message, 10)}
+	h.register <- bob
+	if msg := <-bob.send; msg.Content != "bob has joined." {
+		t.Fatalf("bob got %q, want their own join notice", msg.Content)
+	}
+	h.unregister <- bob
+	h.getUserList() // Wait for the hub to handle the leave.
+	if len(alice.send) != 0 {
+		t.Fatalf("alice in #ops got %q, want no news from the lobby", (<-alice.send).Content)
+	}
+}
+
+func TestHubNetsplitAndNetjoin(t *testing.T) {
+	h := newHub()
+	c := &Client{user: "alice", send: make(chan Message, 10)}
+	h.clients[c] = true
+	h.clientsByName[c.User()] = c
+
+	h.applyNickSync(nickSyncRequest{serverAddr: "srv:22", nicks: []string{"bob", "carol"}})
+	if len(c.send) != 0 {
+		t.Fatal("first nick sync from a new peer should not announce a netjoin")
+	}
+
+	h.handleNetsplit("srv:22")
+	if _, ok := h.remoteNicks["srv:22"]; ok {
+		t.Fatal("remote nicks should be purged on netsplit")
+	}
+	if h.isNameTakenInFederation("bob") {
+		t.Fatal("names from a split peer should be free again")
+	}
+	msg := <-c.send
+	if !strings.Contains(msg.Content, "Netsplit") || !strings.Contains(msg.Content, "bob, carol") {
+		t.Fatalf("unexpected netsplit announcement: %q", msg.Content)
+	}
+
+	h.applyNickSync(nickSyncRequest{serverAddr: "srv:22", nicks: []string{"bob"}})
+	msg = <-c.send
+	if !strings.Contains(msg.Content, "Netjoin") || !strings.Contains(msg.Content, "bob") {
+		t.Fatalf("unexpected netjoin announcement: %q", msg.Content)
+	}
+
+	h.applyNickSync(nickSyncRequest{serverAddr: "srv:22", nicks: []string{"bob"}})
+	if len(c.send) != 0 {
+		t.Fatal("only the first nick sync after a netsplit should announce a netjoin")
+	}
+}
+
+func TestHubHoldsAnonymousUsersWhenBlocked(t *testing.T) {
+	h := newHub()
+	f, err := NewFederation(h, FederationConfig{}, nil)
+	if err != nil {
+		t.Fatalf("NewFederation error: %v", err)
+	}
+	h.federation = f
+	h.anonymousPolicy = anonymousBlocked
+	go h.run()
+
+	member := &Client{user: "octocat", isAuthed: true, send: make(chan Message, 10)}
+	h.register <- member
+	if msg := <-member.send; msg.Content != "octocat has joined." {
+		t.Fatalf("member got %q, want their own join notice", msg.Content)
+	}
+
+	anon := &Client{user: "Anonymous1234", send: make(chan Message, 10)}
+	h.register <- anon
+	if users := h.getUserList(); len(users) != 1 {
+		t.Fatalf("users = %v, want the anonymous user kept out", users)
+	}
+	h.requestNameChange(anon, "sneaky", false)
+	h.requestNameChange(anon, "hubot", true)
+	if msg := <-member.send; msg.Content != "hubot has joined." {
+		t.Fatalf("member got %q, want a join under the GitHub login", msg.Content)
+	}
+	<-anon.send // own join notice
+	if !anon.IsAuthed() || anon.User() != "hubot" {
+		t.Fatalf("admitted user = %s (authed %v)", anon.User(), anon.IsAuthed())
+	}
+
+	// A login held by a GitHub user on another server cannot be taken, and
+	// the user who tried stays outside.
+	h.syncNicks <- nickSyncRequest{serverAddr: "beta:22", nicks: []string{"taken"}, routes: map[string]nickRoute{
+		"taken": {Path: []string{"B"}, Server: "beta", Clock: 1, Authed: true},
+	}}
+	late := &Client{user: "Anonymous4321", send: make(chan Message, 10)}
+	h.register <- late
+	h.requestNameChange(late, "taken", true)
+	if msg := <-late.send; msg.Content != "Name 'taken' is already taken on beta." {
+		t.Fatalf("late got %q, want the remote holder named", msg.Content)
+	}
+	if users := h.getLocalUserList(); len(users) != 2 || late.IsAuthed() {
+		t.Fatalf("users = %v (late authed %v), want the late user still outside", users, late.IsAuthed())
+	}
+
+	// A user who loses their GitHub name goes back to waiting.
+	h.requestNameChange(late, "hubot", true)
+	if msg := <-anon.send; !strings.HasPrefix(msg.Content, "Your name was changed to ") {
+		t.Fatalf("anon got %q, want the rename notice", msg.Content)
+	}
+	<-anon.send // the rename announcement
+	if msg := <-anon.send; !strings.HasPrefix(msg.Content, "This server only admits GitHub users.") {
+		t.Fatalf("anon got %q, want to be held outside", msg.Content)
+	}
+	for _, want := range []string{" has been renamed to ", " has left.", "hubot has joined."} {
+		if msg := <-member.send; !strings.Contains(msg.Content, want) {
+			t.Fatalf("member got %q, want %q", msg.Content, want)
+		}
+	}
+	if users := h.getLocalUserList(); len(users) != 2 || anon.IsAuthed() || !late.IsAuthed() {
+		t.Fatalf("users = %v, want octocat and the new hubot only", users)
+	}
+	<-late.send // own join notice
+
+	// So does one who loses a nick conflict to an earlier GitHub claim.
+	h.syncNicks <- nickSyncRequest{serverAddr: "beta:22", nicks: []string{"hubot"}, routes: map[string]nickRoute{
+		"hubot": {Path: []string{"B"}, Server: "beta", Clock: 1, Authed: true},
+	}}
+	if msg := <-late.send; !strings.Contains(msg.Content, "has priority for the name 'hubot'") {
+		t.Fatalf("late got %q, want the conflict rename", msg.Content)
+	}
+	<-late.send // the rename announcement
+	if msg := <-late.send; !strings.HasPrefix(msg.Content, "This server only admits GitHub users.") {
+		t.Fatalf("late got %q, want to be held outside", msg.Content)
+	}
+	if users := h.getLocalUserList(); len(users) != 1 || users[0] != "octocat" {
+		t.Fatalf("users = %v, want only octocat left in the chat", users)
+	}
+
+	quitter := &Client{user: "Anonymous5678", send: make(chan Message, 10)}
+	h.register <- quitter
+	h.unregister <- quitter
+	if _, open := <-quitter.send; open {
+		t.Fatal("a waiting client's send channel should be closed when it leaves")
+	}
+}
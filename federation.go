@@ -1,14 +1,12 @@
 package main
 
 import (
-	"bufio"
-	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
 	"strings"
@@ -26,58 +24,194 @@ type FederationMessage struct {
 }
 
 type NickSyncPayload struct {
-	Nicks []string `json:"nicks"`
+	Nicks    []string             `json:"nicks"`
+	Paths    map[string][]string  `json:"paths,omitempty"`   // Nick -> server IDs to its home server
+	Servers  map[string]string    `json:"servers,omitempty"` // Nick -> name of its home server
+	Claims   map[string]NickClaim `json:"claims,omitempty"`  // Nick -> claim used to settle conflicts
+	Seq      uint64               `json:"seq"`
+	Checksum string               `json:"checksum,omitempty"`
 }
 
 type PrivateMessagePayload struct {
-	From string `json:"from"`
-	To   string `json:"to"`
-	Text string `json:"text"`
+	From         string `json:"from"`
+	FromServer   string `json:"from_server,omitempty"`
+	FromAuthed   bool   `json:"from_authed,omitempty"`
+	FromProvider string `json:"from_provider,omitempty"`
+	To           string `json:"to"`
+	ToServer     string `json:"to_server,omitempty"` // Set when the sender addressed nick@server
+	ID           string `json:"id,omitempty"`        // Echoed in the delivery receipt
+	Text         string `json:"text"`
+	Hops         int    `json:"hops,omitempty"`
+}
+
+type PublicMessagePayload struct {
+	From           string `json:"from"`
+	Server         string `json:"server,omitempty"` // Name of the author's home server
+	Text           string `json:"text"`
+	Room           string `json:"room,omitempty"`
+	AuthorIsAuthed bool   `json:"author_is_authed"`
+	AuthProvider   string `json:"auth_provider,omitempty"`
+	ID             string `json:"id,omitempty"`
+	Hops           int    `json:"hops,omitempty"`
 }
 
 type NameChangePayload struct {
 	OldName      string `json:"old_name"`
 	NewName      string `json:"new_name"`
 	IsGitHubAuth bool   `json:"is_github_auth"`
-}
-
-type AuthPayload struct {
-	Secret string `json:"secret"`
+	Provider     string `json:"provider,omitempty"` // Auth provider when IsGitHubAuth is set
+	Clock        uint64 `json:"clock,omitempty"`    // Lamport timestamp of the claim on NewName
+	ID           string `json:"id,omitempty"`
+	Hops         int    `json:"hops,omitempty"`
 }
 
 type Federation struct {
-	servers []*ServerConnection
-	hub     *Hub
+	mu          sync.RWMutex
+	servers     []*ServerConnection
+	hub         *Hub
+	nonces      *nonceCache
+	serverID    string
+	serverName  string           // Configured name, shown to users as nick@serverName
+	config      FederationConfig // Settings applied to peers added at runtime
+	signer      cryptossh.Signer
+	pendingKeys *pendingHostKeys // Unknown host keys awaiting approval, nil unless TOFU is on
 }
 
-const federationAuthTimeout = 15 * time.Second
+var (
+	// errLinkActive turns away a second link to a peer that is already linked.
+	errLinkActive = errors.New("another link to this peer is already up")
+	// errLinkReplaced ends a link that gave way to the preferred one.
+	errLinkReplaced = errors.New("replaced by the link dialled by the lower server ID")
+)
 
-func NewFederation(hub *Hub, serverAddresses []string, knownHostsPath, sharedSecret string) (*Federation, error) {
-	if len(serverAddresses) > 0 {
-		if strings.TrimSpace(sharedSecret) == "" {
-			return nil, errors.New("shared federation secret is required when federation servers are configured")
-		}
-		if err := ensureKnownHostsFile(knownHostsPath); err != nil {
+// Directions of a federation link, seen from this server.
+const (
+	linkOutbound = "outbound"
+	linkInbound  = "inbound"
+)
+
+const (
+	federationAuthTimeout           = 15 * time.Second
+	federationInitialBackoff        = time.Second
+	defaultFederationReconnectDelay = 5 * time.Minute
+)
+
+const (
+	linkIdle           = "idle"
+	linkConnecting     = "connecting"
+	linkAuthenticating = "authenticating"
+	linkAuthenticated  = "authenticated"
+	linkBackingOff     = "backing off"
+	linkDisabled       = "disabled"
+)
+
+type linkStatus struct {
+	State     string
+	NextRetry time.Time
+	Peer      *peerInfo
+	RTT       time.Duration
+	LastSeen  time.Time
+	Queued    int
+	QueueSize int
+	Dropped   uint64
+	// Disconnects counts links closed because a frame that cannot be
+	// dropped did not fit in the queue.
+	Disconnects uint64
+}
+
+func NewFederation(hub *Hub, fc FederationConfig, signer cryptossh.Signer) (*Federation, error) {
+	if len(fc.Servers) > 0 {
+		if err := ensureKnownHostsFile(fc.KnownHostsPath); err != nil {
 			return nil, fmt.Errorf("prepare known_hosts file: %w", err)
 		}
 	}
 
 	f := &Federation{
-		hub: hub,
+		hub:      hub,
+		nonces:   newNonceCache(federationNonceTTL),
+		serverID: serverIDFromSigner(signer),
+		config:   fc,
+		signer:   signer,
+	}
+	if fc.TrustOnFirstUse {
+		f.pendingKeys = newPendingHostKeys()
+	}
+	f.serverName = normalizeServerName(fc.ServerName)
+	if f.serverName == "" {
+		f.serverName = f.serverID
 	}
-	for _, addr := range serverAddresses {
-		sc := NewServerConnection(addr, hub, knownHostsPath, sharedSecret)
+	peerKeys, err := parsePeerKeys(fc.PeerKeys)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fc.moderationTrust(); err != nil {
+		return nil, err
+	}
+	disabled := make(map[string]bool, len(fc.Disabled))
+	for _, addr := range fc.Disabled {
+		disabled[strings.TrimSpace(addr)] = true
+	}
+	for _, addr := range fc.Servers {
+		secret, err := fc.secretFor(addr)
+		if err != nil {
+			return nil, err
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("no federation secret configured for %s", addr)
+		}
+
+		sc := f.newPeer(addr, secret, peerKeys[addr])
+		if sc.peerKey == nil {
+			log.Printf("No peer_keys entry for federation server %s; inbound connections from it will be rejected", addr)
+		}
+		sc.disabled = disabled[addr]
 		f.servers = append(f.servers, sc)
 	}
 	return f, nil
 }
 
+// newPeer builds a connection to addr with the federation-wide settings.
+func (f *Federation) newPeer(addr, secret string, peerKey cryptossh.PublicKey) *ServerConnection {
+	fc := f.config
+	sc := NewServerConnection(addr, f.hub, fc.KnownHostsPath, secret)
+	sc.nonces = f.nonces
+	sc.signer = f.signer
+	sc.localID = f.serverID
+	sc.localName = f.serverName
+	sc.peerKey = peerKey
+	sc.pendingKeys = f.pendingKeys
+	if fc.ReconnectMaxDelay > 0 {
+		sc.reconnectMaxDelay = fc.ReconnectMaxDelay
+	}
+	if fc.HeartbeatInterval > 0 {
+		sc.heartbeatInterval = fc.HeartbeatInterval
+	}
+	if fc.HeartbeatMisses > 0 {
+		sc.heartbeatMisses = fc.HeartbeatMisses
+	}
+	if fc.OutboundQueueSize > 0 {
+		sc.queueSize = fc.OutboundQueueSize
+	}
+	if trust, err := fc.moderationTrust(); err == nil && trust[addr] != "" {
+		sc.moderationTrust = trust[addr]
+	}
+	return sc
+}
+
 func (f *Federation) Start() {
-	for _, sc := range f.servers {
-		go sc.Connect()
+	for _, sc := range f.Peers() {
+		go sc.maintainConnection()
 	}
 }
 
+// Peers returns a snapshot of the configured peers. The list can change at
+// runtime, so callers iterate the copy rather than f.servers.
+func (f *Federation) Peers() []*ServerConnection {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]*ServerConnection(nil), f.servers...)
+}
+
 func ensureKnownHostsFile(path string) error {
 	if strings.TrimSpace(path) == "" {
 		return errors.New("known_hosts path cannot be empty")
@@ -115,15 +249,107 @@ func ensureKnownHostsFile(path string) error {
 func (sc *ServerConnection) setConnection(stdin io.Writer) {
 	sc.mu.Lock()
 	defer sc.mu.Unlock()
+	sc.attachLocked(stdin)
+}
+
+// beginLink attaches channel unless another link to the peer is already up.
+// Peers that list each other dial in both directions, and only one of the
+// two links may carry the session. When both links come up at once, both
+// ends keep the one dialled by the server with the lower ID: a link in that
+// direction replaces one in the other, which is returned to be closed along
+// with whether it had been authenticated.
+func (sc *ServerConnection) beginLink(channel io.Writer, direction string) (replaced io.Closer, wasAuthenticated, ok bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.stdin != nil {
+		if direction == sc.direction || direction != sc.preferredDirectionLocked() {
+			return nil, false, false
+		}
+		replaced, wasAuthenticated = sc.link, sc.authenticated
+	}
+	sc.attachLocked(channel)
+	sc.direction = direction
+	return replaced, wasAuthenticated, true
+}
+
+// preferredDirectionLocked is the direction of the link dialled by whichever
+// of us and the peer has the lower server ID, "" if the peer's key is unknown.
+func (sc *ServerConnection) preferredDirectionLocked() string {
+	if sc.peerKey == nil || sc.localID == "" {
+		return ""
+	}
+	if sc.localID < serverIDFromKey(sc.peerKey) {
+		return linkOutbound
+	}
+	return linkInbound
+}
+
+// isLink reports whether channel is the link currently carrying the session.
+func (sc *ServerConnection) isLink(channel io.Writer) bool {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.stdin == channel
+}
+
+func (sc *ServerConnection) hasLink() bool {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.stdin != nil
+}
+
+func (sc *ServerConnection) attachLocked(stdin io.Writer) {
 	sc.stdin = stdin
 	sc.authenticated = false
+	sc.localNonce = ""
+	sc.peerNonce = ""
+	sc.peer = nil
+	sc.outSeq = 0
+	sc.inSeq = 0
+	sc.missedBeats = 0
+	sc.rtt = 0
+	sc.outbound = nil
+	sc.link = nil
 }
 
 func (sc *ServerConnection) resetConnection() {
 	sc.mu.Lock()
-	defer sc.mu.Unlock()
+	wasAuthenticated := sc.detachLocked()
+	sc.mu.Unlock()
+
+	if wasAuthenticated {
+		sc.hub.notifyLinkLost(sc.addr)
+	}
+}
+
+// endLink is resetConnection for a link whose session is over; it leaves
+// alone a link that has replaced it in the meantime.
+func (sc *ServerConnection) endLink(channel io.Writer) {
+	sc.mu.Lock()
+	if sc.stdin != channel {
+		sc.mu.Unlock()
+		return
+	}
+	wasAuthenticated := sc.detachLocked()
+	sc.mu.Unlock()
+
+	if wasAuthenticated {
+		sc.hub.notifyLinkLost(sc.addr)
+	}
+}
+
+// detachLocked drops the current link and reports whether it was
+// authenticated.
+func (sc *ServerConnection) detachLocked() bool {
+	wasAuthenticated := sc.authenticated
 	sc.stdin = nil
+	sc.direction = ""
 	sc.authenticated = false
+	sc.localNonce = ""
+	sc.peerNonce = ""
+	sc.peer = nil
+	sc.outbound = nil
+	sc.link = nil
+	return wasAuthenticated
 }
 
 func (sc *ServerConnection) getConnectionWriter() io.Writer {
@@ -136,6 +362,38 @@ func (sc *ServerConnection) setAuthenticated(authenticated bool) {
 	sc.mu.Lock()
 	defer sc.mu.Unlock()
 	sc.authenticated = authenticated
+	if authenticated {
+		sc.lastAuthenticated = time.Now()
+	}
+}
+
+func (sc *ServerConnection) lastAuthenticatedAt() time.Time {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.lastAuthenticated
+}
+
+func (sc *ServerConnection) setLinkState(state string, nextRetry time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.state = state
+	sc.nextRetry = nextRetry
+}
+
+// Status reports the current link state for display in /s.
+func (sc *ServerConnection) Status() linkStatus {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	status := linkStatus{State: sc.state, NextRetry: sc.nextRetry, Peer: sc.peer, RTT: sc.rtt, LastSeen: sc.lastSeen,
+		Queued: len(sc.outbound), QueueSize: sc.queueSize, Dropped: sc.framesDropped, Disconnects: sc.overflowDisconnects}
+	if sc.authenticated {
+		status.State = linkAuthenticated
+		status.NextRetry = time.Time{}
+	}
+	if status.State == "" {
+		status.State = linkIdle
+	}
+	return status
 }
 
 func (sc *ServerConnection) isAuthenticated() bool {
@@ -144,64 +402,63 @@ func (sc *ServerConnection) isAuthenticated() bool {
 	return sc.authenticated
 }
 
-func (f *Federation) HandleNewServer(s ssh.Session) {
-	log.Printf("Handling new federation connection from %s", s.RemoteAddr().String())
-	remoteHost, _, err := net.SplitHostPort(s.RemoteAddr().String())
-	if err != nil {
-		log.Printf("Failed to parse remote address: %v", err)
-		_ = s.Close()
-		return
+// serverForKey returns the configured peer whose public key matches key.
+func (f *Federation) serverForKey(key cryptossh.PublicKey) *ServerConnection {
+	if key == nil {
+		return nil
+	}
+	for _, sc := range f.Peers() {
+		if peerKey := sc.getPeerKey(); peerKey != nil && ssh.KeysEqual(peerKey, key) {
+			return sc
+		}
 	}
+	return nil
+}
 
-	for _, sc := range f.servers {
-		serverHost, _, err := net.SplitHostPort(sc.addr)
-		if err != nil {
-			log.Printf("Failed to parse server address: %v", err)
-			continue
+// IsPeerKey reports whether key belongs to a configured federation peer. It
+// backs the SSH server's PublicKeyHandler for the federation user.
+func (f *Federation) IsPeerKey(key cryptossh.PublicKey) bool {
+	return f.serverForKey(key) != nil
+}
+
+func (f *Federation) serverByAddr(addr string) *ServerConnection {
+	for _, sc := range f.Peers() {
+		if sc.addr == addr {
+			return sc
 		}
-		if remoteHost == serverHost {
-			sc.setConnection(s)
-			if err := sc.sendAuth(); err != nil {
-				log.Printf("Failed to send federation auth to %s: %v", sc.addr, err)
-				sc.resetConnection()
-				_ = s.Close()
-				return
-			}
+	}
+	return nil
+}
 
-			go func(sess ssh.Session, conn *ServerConnection) {
-				select {
-				case <-time.After(federationAuthTimeout):
-					if !conn.isAuthenticated() {
-						log.Printf("Closing unauthenticated federation session from %s after timeout", sess.RemoteAddr().String())
-						_ = sess.Close()
-					}
-				case <-sess.Context().Done():
-				}
-			}(s, sc)
-
-			go sc.handleConnection(s)
-			go sc.startNickSync()
-			<-s.Context().Done()
-			sc.resetConnection()
-			log.Printf("Federation connection from %s closed", s.RemoteAddr().String())
-			return
+// BroadcastNameChange announces a local rename to every peer.
+func (f *Federation) BroadcastNameChange(oldName, newName string, isGitHubAuth bool, clock uint64) {
+	id := newMessageID()
+	f.hub.markSeen(id)
+	payload := NameChangePayload{OldName: oldName, NewName: newName, IsGitHubAuth: isGitHubAuth, Clock: clock, ID: id, Hops: 1}
+	if isGitHubAuth {
+		payload.Provider = authProviderGitHub
+	}
+	f.relayNameChange(payload, "")
+}
+
+// relayNameChange sends a rename to every peer except the one at except.
+func (f *Federation) relayNameChange(payload NameChangePayload, except string) {
+	for _, s := range f.Peers() {
+		if s.addr == except {
+			continue
 		}
+		s.sendNameChange(payload)
 	}
-	log.Printf("Ignoring connection from unknown server %s", s.RemoteAddr().String())
-	_ = s.Close()
 }
 
-func (f *Federation) BroadcastNameChange(oldName, newName string, isGitHubAuth bool) {
-	// Create a WaitGroup to ensure all servers receive the update
-	var wg sync.WaitGroup
-	for _, s := range f.servers {
-		wg.Add(1)
-		go func(server *ServerConnection) {
-			defer wg.Done()
-			server.sendNameChange(oldName, newName, isGitHubAuth)
-		}(s)
+// BroadcastPublicMessage floods msg to every peer except the one at except.
+func (f *Federation) BroadcastPublicMessage(msg Message, hops int, except string) {
+	for _, s := range f.Peers() {
+		if s.addr == except {
+			continue
+		}
+		s.sendPublicMessage(msg, hops)
 	}
-	wg.Wait()
 }
 
 type ServerConnection struct {
@@ -210,132 +467,299 @@ type ServerConnection struct {
 	knownHostsPath string
 	sharedSecret   string
 
-	mu            sync.RWMutex
-	writeMu       sync.Mutex
-	stdin         io.Writer
-	authenticated bool
+	reconnectMaxDelay time.Duration
+	heartbeatInterval time.Duration
+	heartbeatMisses   int
+	queueSize         int
+	nonces            *nonceCache
+	localID           string           // Our server ID, sent in hello
+	localName         string           // Our server name, sent in hello
+	signer            cryptossh.Signer // Our key, used to log in to the peer
+	pendingKeys       *pendingHostKeys // Set in trust-on-first-use mode
+	moderationTrust   string           // Moderation actions from this peer that we apply
+	linkMu            sync.Mutex       // Held while a link is set up, so links never interleave
+
+	mu                  sync.RWMutex
+	peerKey             cryptossh.PublicKey // The peer's key, used to recognise inbound links
+	writeMu             sync.Mutex
+	stdin               io.Writer
+	direction           string // Direction of the current link, linkOutbound or linkInbound
+	authenticated       bool
+	lastAuthenticated   time.Time
+	localNonce          string
+	peerNonce           string
+	peer                *peerInfo
+	lastSeen            time.Time
+	rtt                 time.Duration
+	missedBeats         int
+	outbound            chan []byte // Frames waiting for the link's writer goroutine
+	link                io.Closer
+	framesDropped       uint64
+	overflowDisconnects uint64
+	outSeq              uint64 // Last nick delta sequence number we sent
+	inSeq               uint64 // Last nick delta sequence number we applied
+	state               string
+	nextRetry           time.Time
+	disabled            bool          // Set by an admin; no link is kept while true
+	stop                chan struct{} // Closed when the peer is removed
+	wake                chan struct{} // Cuts a backoff or disabled wait short
 }
 
 func NewServerConnection(addr string, hub *Hub, knownHostsPath, sharedSecret string) *ServerConnection {
 	return &ServerConnection{
-		addr:           addr,
-		hub:            hub,
-		knownHostsPath: knownHostsPath,
-		sharedSecret:   sharedSecret,
+		addr:              addr,
+		hub:               hub,
+		knownHostsPath:    knownHostsPath,
+		sharedSecret:      sharedSecret,
+		reconnectMaxDelay: defaultFederationReconnectDelay,
+		heartbeatInterval: defaultHeartbeatInterval,
+		heartbeatMisses:   defaultHeartbeatMisses,
+		queueSize:         defaultOutboundQueueSize,
+		nonces:            newNonceCache(federationNonceTTL),
+		moderationTrust:   moderationTrustNone,
+		stop:              make(chan struct{}),
+		wake:              make(chan struct{}, 1),
 	}
 }
 
-func (sc *ServerConnection) Connect() {
+// maintainConnection keeps an outbound link to the peer alive, retrying with
+// jittered exponential backoff whenever the session ends or cannot be set up.
+// It idles while the peer is disabled and returns once the peer is removed.
+func (sc *ServerConnection) maintainConnection() {
+	failures := 0
+	for {
+		if !sc.waitUntilEnabled() {
+			return
+		}
+		if sc.hasLink() {
+			// The peer dialled us; check again later rather than dialling
+			// a second link that would be turned away.
+			if !sc.sleep(sc.heartbeatInterval) {
+				return
+			}
+			continue
+		}
+		sc.setLinkState(linkConnecting, time.Time{})
+		authenticated, err := sc.Connect()
+		if err != nil {
+			log.Printf("Federation link to %s failed: %v", sc.addr, err)
+		}
+		if authenticated {
+			failures = 0
+		}
+		if sc.isRemoved() {
+			return
+		}
+		if sc.isDisabled() {
+			continue
+		}
+
+		delay := backoffDelay(failures, sc.reconnectMaxDelay)
+		failures++
+		sc.setLinkState(linkBackingOff, time.Now().Add(delay))
+		log.Printf("Reconnecting to federated server at %s in %s", sc.addr, delay.Round(time.Millisecond))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-sc.wake:
+			timer.Stop()
+			failures = 0
+		case <-sc.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// sleep waits for d, or less if the peer is woken up, and reports whether
+// the peer is still configured.
+func (sc *ServerConnection) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-sc.wake:
+	case <-sc.stop:
+		return false
+	}
+	return true
+}
+
+// backoffDelay returns the wait before retry number attempt: the base delay
+// doubles per attempt up to maxDelay, and the result is jittered into the
+// upper half of that window so peers do not reconnect in lockstep.
+func backoffDelay(attempt int, maxDelay time.Duration) time.Duration {
+	if maxDelay < federationInitialBackoff {
+		maxDelay = federationInitialBackoff
+	}
+
+	delay := federationInitialBackoff
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+// Connect runs a single outbound federation session and reports whether the
+// link was authenticated before it ended.
+func (sc *ServerConnection) Connect() (bool, error) {
 	hostKeyCallback, err := knownhosts.New(sc.knownHostsPath)
 	if err != nil {
-		log.Printf("Failed to load federation known_hosts from %s: %v", sc.knownHostsPath, err)
-		return
+		return false, fmt.Errorf("load known_hosts from %s: %w", sc.knownHostsPath, err)
+	}
+
+	var auth []cryptossh.AuthMethod
+	if sc.signer != nil {
+		auth = append(auth, cryptossh.PublicKeys(sc.signer))
 	}
 
 	config := &cryptossh.ClientConfig{
 		User:            "federation",
-		Auth:            []cryptossh.AuthMethod{},
-		HostKeyCallback: hostKeyCallback,
+		Auth:            auth,
+		HostKeyCallback: sc.checkHostKey(hostKeyCallback),
 		Timeout:         10 * time.Second,
 	}
 
+	started := time.Now()
 	client, err := cryptossh.Dial("tcp", sc.addr, config)
 	if err != nil {
-		log.Printf("Failed to dial federated server at %s: %v", sc.addr, err)
-		return
+		return false, fmt.Errorf("dial: %w", err)
 	}
 	defer client.Close()
 
-	session, err := client.NewSession()
-	if err != nil {
-		log.Printf("Failed to create session with federated server at %s: %v", sc.addr, err)
-		return
-	}
-	defer session.Close()
-
-	stdin, err := session.StdinPipe()
+	channel, reqs, err := client.OpenChannel(federationChannelType, nil)
 	if err != nil {
-		log.Printf("Failed to get stdin pipe: %v", err)
-		return
+		return false, fmt.Errorf("open %s channel: %w", federationChannelType, err)
 	}
+	go cryptossh.DiscardRequests(reqs)
 
-	stdout, err := session.StdoutPipe()
-	if err != nil {
-		log.Printf("Failed to get stdout pipe: %v", err)
-		return
-	}
+	log.Printf("Successfully connected to federated server at %s", sc.addr)
 
-	modes := cryptossh.TerminalModes{
-		cryptossh.ECHO:          0,
-		cryptossh.TTY_OP_ISPEED: 14400,
-		cryptossh.TTY_OP_OSPEED: 14400,
+	if err := sc.serveLink(channel, linkOutbound); err != nil {
+		return sc.lastAuthenticatedAt().After(started), err
 	}
+	return sc.lastAuthenticatedAt().After(started), nil
+}
 
-	if err := session.RequestPty("xterm", 80, 40, modes); err != nil {
-		log.Printf("request for pseudo terminal failed: %s", err)
-		return
-	}
+// serveLink runs the federation protocol over an established channel until it
+// closes. It is shared by outbound links and inbound channels.
+func (sc *ServerConnection) serveLink(channel io.ReadWriteCloser, direction string) error {
+	defer channel.Close()
 
-	if err := session.Shell(); err != nil {
-		log.Printf("failed to start shell: %s", err)
-		return
+	sc.linkMu.Lock()
+	replaced, wasAuthenticated, ok := sc.beginLink(channel, direction)
+	if !ok {
+		sc.linkMu.Unlock()
+		return errLinkActive
 	}
-
-	sc.setConnection(stdin)
+	sc.setLinkState(linkAuthenticating, time.Time{})
 	if err := sc.sendAuth(); err != nil {
-		log.Printf("Failed to send federation auth to %s: %v", sc.addr, err)
-		sc.resetConnection()
-		return
+		sc.endLink(channel)
+		sc.linkMu.Unlock()
+		return fmt.Errorf("send auth: %w", err)
 	}
 
-	log.Printf("Successfully connected to federated server at %s", sc.addr)
+	done := make(chan struct{})
+	defer close(done)
+	sc.startWriter(channel, done)
+	sc.linkMu.Unlock()
+
+	if replaced != nil {
+		log.Printf("Replacing federation link with %s by the %s link", sc.addr, direction)
+		_ = replaced.Close()
+	}
+	if wasAuthenticated {
+		sc.hub.notifyLinkLost(sc.addr)
+	}
 
 	go func() {
-		time.Sleep(federationAuthTimeout)
-		if !sc.isAuthenticated() {
-			log.Printf("Closing unauthenticated outbound federation session to %s after timeout", sc.addr)
-			_ = session.Close()
+		select {
+		case <-time.After(federationAuthTimeout):
+			if !sc.isAuthenticated() {
+				log.Printf("Closing unauthenticated %s federation link with %s after timeout", direction, sc.addr)
+				_ = channel.Close()
+			}
+		case <-done:
 		}
 	}()
 
-	go sc.handleConnection(stdout)
-	go sc.startNickSync()
+	go sc.startNickSync(done)
+	go sc.runHeartbeat(channel, done)
+	err := sc.handleConnection(currentLinkReader{sc: sc, channel: channel})
+	sc.endLink(channel)
+	return err
+}
+
+// currentLinkReader reads from channel until another link replaces it, so
+// frames still arriving on the old link are never acted on.
+type currentLinkReader struct {
+	sc      *ServerConnection
+	channel io.ReadWriter
+}
 
-	if err := session.Wait(); err != nil {
-		log.Printf("Federation session with %s closed: %v", sc.addr, err)
+func (r currentLinkReader) Read(p []byte) (int, error) {
+	n, err := r.channel.Read(p)
+	if !r.sc.isLink(r.channel) {
+		return 0, errLinkReplaced
 	}
-	sc.resetConnection()
+	return n, err
 }
 
-func (sc *ServerConnection) handleConnection(stdout io.Reader) {
-	scanner := bufio.NewScanner(stdout)
-	scanner.Buffer(make([]byte, 0, 64*1024), 256*1024)
+// handleConnection reads frames until the link fails. It returns nil on a
+// clean EOF.
+func (sc *ServerConnection) handleConnection(r io.Reader) error {
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("read frame: %w", err)
+		}
 
-	for scanner.Scan() {
-		line := scanner.Bytes()
+		sc.recordActivity()
 
 		var msg FederationMessage
-		if err := json.Unmarshal(line, &msg); err != nil {
+		if err := json.Unmarshal(frame, &msg); err != nil {
 			log.Printf("Failed to decode federation message from %s: %v", sc.addr, err)
 			continue
 		}
 
-		if msg.Type == "auth" {
-			var payload AuthPayload
+		switch msg.Type {
+		case "auth_challenge":
+			var payload AuthChallengePayload
 			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				log.Printf("Failed to decode federation auth payload from %s: %v", sc.addr, err)
+				log.Printf("Failed to decode federation auth challenge from %s: %v", sc.addr, err)
 				continue
 			}
-
-			if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(payload.Secret)), []byte(strings.TrimSpace(sc.sharedSecret))) != 1 {
-				log.Printf("Federation auth failed for %s", sc.addr)
-				return
+			if err := sc.answerChallenge(payload); err != nil {
+				sc.auditAuthFailure(err)
+				return fmt.Errorf("federation auth failed: %w", err)
+			}
+			continue
+		case "auth_response":
+			var payload AuthResponsePayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				log.Printf("Failed to decode federation auth response from %s: %v", sc.addr, err)
+				continue
+			}
+			if err := sc.verifyResponse(payload); err != nil {
+				sc.auditAuthFailure(err)
+				return fmt.Errorf("federation auth failed: %w", err)
 			}
 
 			if !sc.isAuthenticated() {
 				log.Printf("Federation link authenticated for %s", sc.addr)
 			}
 			sc.setAuthenticated(true)
+			if err := sc.sendHello(); err != nil {
+				return fmt.Errorf("send hello: %w", err)
+			}
 			continue
 		}
 
@@ -345,116 +769,207 @@ func (sc *ServerConnection) handleConnection(stdout io.Reader) {
 		}
 
 		switch msg.Type {
+		case "ping":
+			sc.sendPong(msg.Payload)
+		case "pong":
+			var payload PingPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				log.Printf("Failed to unmarshal pong payload: %v", err)
+				continue
+			}
+			sc.recordPong(payload)
+		case "hello":
+			var payload HelloPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				log.Printf("Failed to unmarshal hello payload: %v", err)
+				continue
+			}
+			if err := sc.handleHello(payload); err != nil {
+				return err
+			}
 		case "nick_sync":
 			var payload NickSyncPayload
 			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 				log.Printf("Failed to unmarshal nick_sync payload: %v", err)
 				continue
 			}
-			sc.hub.syncNicks <- nickSyncRequest{serverAddr: sc.addr, nicks: payload.Nicks}
+			sc.resetInSeq(payload.Seq)
+			sc.hub.syncNicks <- nickSyncRequest{serverAddr: sc.addr, nicks: payload.Nicks, routes: payload.routes()}
+		case "user_join", "user_leave":
+			var payload UserDeltaPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				log.Printf("Failed to unmarshal %s payload: %v", msg.Type, err)
+				continue
+			}
+			if !sc.advanceInSeq(payload.Seq) {
+				log.Printf("Nick delta sequence gap from %s at %d; requesting a snapshot", sc.addr, payload.Seq)
+				sc.sendNickSyncRequest()
+			}
+			sc.hub.remoteUserDelta <- remoteUserDeltaRequest{serverAddr: sc.addr, nick: payload.Nick, joined: msg.Type == "user_join", route: payload.route()}
+		case "nick_checksum":
+			var payload NickChecksumPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				log.Printf("Failed to unmarshal nick_checksum payload: %v", err)
+				continue
+			}
+			if payload.Seq != sc.currentInSeq() {
+				// Deltas are still in flight; the next checksum will catch up.
+				continue
+			}
+			sc.hub.verifyNicks <- nickChecksumRequest{conn: sc, checksum: payload.Checksum}
+		case "nick_sync_request":
+			sc.hub.requestNickSnapshot(sc, true)
 		case "private_message":
 			var payload PrivateMessagePayload
 			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 				log.Printf("Failed to unmarshal private_message payload: %v", err)
 				continue
 			}
-			sc.hub.sendPrivateMessage(payload.To, Message{Author: payload.From, Content: payload.Text, Type: "private"}, nil)
+			sc.hub.privateMsgChan <- privateMessagePayload{
+				TargetUser:   normalizeUsername(payload.To),
+				TargetServer: normalizeServerName(payload.ToServer),
+				Message: Message{
+					Author:         payload.From,
+					Content:        payload.Text,
+					Type:           "private",
+					Server:         normalizeServerName(payload.FromServer),
+					AuthorIsAuthed: payload.FromAuthed,
+					AuthProvider:   payload.FromProvider,
+				},
+				Hops: payload.Hops,
+				ID:   payload.ID,
+			}
+		case "private_message_ack", "private_message_error":
+			var payload PrivateMessageReceiptPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				log.Printf("Failed to unmarshal %s payload: %v", msg.Type, err)
+				continue
+			}
+			if msg.Type == "private_message_error" && payload.Error == "" {
+				payload.Error = "delivery failed"
+			}
+			sc.hub.privateReceipts <- payload
+		case "public_message":
+			var payload PublicMessagePayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				log.Printf("Failed to unmarshal public_message payload: %v", err)
+				continue
+			}
+			sc.hub.remoteBroadcast <- remotePublicMessage{
+				message: Message{
+					Author:         normalizeUsername(payload.From),
+					Content:        payload.Text,
+					Type:           "public",
+					AuthorIsAuthed: payload.AuthorIsAuthed,
+					AuthProvider:   payload.AuthProvider,
+					Room:           payload.Room,
+					ID:             payload.ID,
+					Server:         normalizeServerName(payload.Server),
+				},
+				hops:       payload.Hops,
+				serverAddr: sc.addr,
+			}
 		case "name_change":
 			var payload NameChangePayload
 			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 				log.Printf("Failed to unmarshal name_change payload: %v", err)
 				continue
 			}
-			sc.hub.remoteNameChange <- remoteNameChangeRequest{oldName: payload.OldName, newName: payload.NewName, isGitHubAuth: payload.IsGitHubAuth, serverAddr: sc.addr}
+			sc.hub.remoteNameChange <- remoteNameChangeRequest{oldName: payload.OldName, newName: payload.NewName, isGitHubAuth: payload.IsGitHubAuth, provider: payload.Provider, clock: payload.Clock, serverAddr: sc.addr, id: payload.ID, hops: payload.Hops}
+		case "moderation_action":
+			var payload ModerationActionPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				log.Printf("Failed to unmarshal moderation_action payload: %v", err)
+				continue
+			}
+			sc.hub.remoteModeration <- remoteModerationRequest{serverAddr: sc.addr, payload: payload}
 		default:
 			log.Printf("Ignoring unknown federation message type %q from %s", msg.Type, sc.addr)
 		}
 	}
-
-	if err := scanner.Err(); err != nil {
-		log.Printf("Federation reader error for %s: %v", sc.addr, err)
-	}
 }
 
-func (sc *ServerConnection) startNickSync() {
-	sc.sendNickSync()
-
-	ticker := time.NewTicker(5 * time.Second) // Increased frequency for better responsiveness
-	defer ticker.Stop()
-
-	for range ticker.C {
-		if sc.getConnectionWriter() == nil {
-			return
-		}
-		sc.sendNickSync()
+// sendPrivateMessage queues a DM for the peer. The error is meant for the
+// sender, so it describes the link rather than the payload.
+func (sc *ServerConnection) sendPrivateMessage(payload PrivateMessagePayload) error {
+	if !sc.isAuthenticated() {
+		log.Printf("Skipping private message via %s: federation link not authenticated", sc.addr)
+		return fmt.Errorf("the link to %s is not authenticated", sc.peerName())
 	}
-}
 
-func (sc *ServerConnection) sendNickSync() {
-	if !sc.isAuthenticated() {
-		return
+	if !sc.supports("private_message") {
+		return fmt.Errorf("%s does not accept private messages", sc.peerName())
 	}
 
 	stdin := sc.getConnectionWriter()
 	if stdin == nil {
-		log.Printf("Skipping nick sync for %s: connection is not ready", sc.addr)
-		return
+		log.Printf("Skipping private message to %s via %s: connection is not ready", payload.To, sc.addr)
+		return fmt.Errorf("the link to %s is down", sc.peerName())
 	}
 
-	nicks := sc.hub.getLocalUserList()
-	payload := NickSyncPayload{Nicks: nicks}
 	b, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Failed to marshal nick_sync payload: %v", err)
-		return
+		log.Printf("Failed to marshal private_message payload: %v", err)
+		return errors.New("the message could not be encoded")
 	}
 
-	msg := FederationMessage{Type: "nick_sync", Payload: b}
-	if err := sc.sendRawMessage(stdin, msg); err != nil {
-		log.Printf("Failed to send nick sync to %s: %v", sc.addr, err)
-		return
+	msg := FederationMessage{Type: "private_message", Payload: b}
+	if err := sc.queueMessage(stdin, msg); err != nil {
+		log.Printf("Failed to send private message via %s: %v", sc.addr, err)
+		return fmt.Errorf("the link to %s is congested", sc.peerName())
 	}
+	return nil
 }
 
-func (sc *ServerConnection) sendPrivateMessage(from, to, text string) {
+func (sc *ServerConnection) sendPublicMessage(m Message, hops int) {
 	if !sc.isAuthenticated() {
-		log.Printf("Skipping private message via %s: federation link not authenticated", sc.addr)
+		return
+	}
+
+	if !sc.supports("public_message") {
 		return
 	}
 
 	stdin := sc.getConnectionWriter()
 	if stdin == nil {
-		log.Printf("Skipping private message to %s via %s: connection is not ready", to, sc.addr)
+		log.Printf("Skipping public message to %s: connection is not ready", sc.addr)
 		return
 	}
 
-	payload := PrivateMessagePayload{From: from, To: to, Text: text}
+	server := m.Server
+	if server == "" {
+		server = sc.localName
+	}
+	payload := PublicMessagePayload{From: m.Author, Server: server, Text: m.Content, Room: m.Room, AuthorIsAuthed: m.AuthorIsAuthed, AuthProvider: m.AuthProvider, ID: m.ID, Hops: hops}
 	b, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Failed to marshal private_message payload: %v", err)
+		log.Printf("Failed to marshal public_message payload: %v", err)
 		return
 	}
 
-	msg := FederationMessage{Type: "private_message", Payload: b}
-	if err := sc.sendRawMessage(stdin, msg); err != nil {
-		log.Printf("Failed to send private message via %s: %v", sc.addr, err)
+	msg := FederationMessage{Type: "public_message", Payload: b}
+	if err := sc.queueMessage(stdin, msg); err != nil {
+		log.Printf("Failed to send public message via %s: %v", sc.addr, err)
 		return
 	}
 }
 
-func (sc *ServerConnection) sendNameChange(oldName, newName string, isGitHubAuth bool) {
+func (sc *ServerConnection) sendNameChange(payload NameChangePayload) {
 	if !sc.isAuthenticated() {
 		log.Printf("Skipping name change via %s: federation link not authenticated", sc.addr)
 		return
 	}
 
+	if !sc.supports("name_change") {
+		return
+	}
+
 	stdin := sc.getConnectionWriter()
 	if stdin == nil {
 		log.Printf("Skipping name change broadcast to %s: connection is not ready", sc.addr)
 		return
 	}
 
-	payload := NameChangePayload{OldName: oldName, NewName: newName, IsGitHubAuth: isGitHubAuth}
 	b, err := json.Marshal(payload)
 	if err != nil {
 		log.Printf("Failed to marshal name_change payload: %v", err)
@@ -462,34 +977,13 @@ func (sc *ServerConnection) sendNameChange(oldName, newName string, isGitHubAuth
 	}
 
 	msg := FederationMessage{Type: "name_change", Payload: b}
-	if err := sc.sendRawMessage(stdin, msg); err != nil {
+	if err := sc.queueMessage(stdin, msg); err != nil {
 		log.Printf("Failed to send name change via %s: %v", sc.addr, err)
 		return
 	}
 
 }
 
-func (sc *ServerConnection) sendAuth() error {
-	payload := AuthPayload{Secret: sc.sharedSecret}
-	// #nosec G117 -- Field name is part of the federation protocol schema.
-	b, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
-
-	msg := FederationMessage{Type: "auth", Payload: b}
-	stdin := sc.getConnectionWriter()
-	if stdin == nil {
-		return errors.New("connection writer is not ready")
-	}
-
-	if err := sc.sendRawMessage(stdin, msg); err != nil {
-		return err
-	}
-
-	return nil
-}
-
 func (sc *ServerConnection) sendRawMessage(stdin io.Writer, msg FederationMessage) error {
 	b, err := json.Marshal(msg)
 	if err != nil {
@@ -499,9 +993,5 @@ func (sc *ServerConnection) sendRawMessage(stdin io.Writer, msg FederationMessag
 	sc.writeMu.Lock()
 	defer sc.writeMu.Unlock()
 
-	if _, err := fmt.Fprintln(stdin, string(b)); err != nil {
-		return err
-	}
-
-	return nil
+	return writeFrame(stdin, b)
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Admins manage peers at runtime with /fed in the chat, or with
+// `ssh host fed <command>` from a key listed in [admins] keys. Changes apply
+// immediately and are only written to the ini file by `fed save`.
+
+const federationAdminCommands = "list | add <host:port> <key-type> <key> [secret] | remove <host:port> | disable <host:port> | enable <host:port> | reconnect <host:port> | pending | approve <host:port> <fingerprint> | reject <host:port> | save"
+
+var errUnknownPeer = errors.New("no such federation peer")
+
+// AddPeer starts federating with addr. keyLine is the peer's host key in
+// authorized_keys format; it is trusted for outbound links and recognises
+// the peer's inbound ones. An empty secret falls back to shared_secret.
+func (f *Federation) AddPeer(addr, keyLine, secret string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	key, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(keyLine))
+	if err != nil {
+		return fmt.Errorf("invalid key: %w", err)
+	}
+	if secret == "" {
+		secret = strings.TrimSpace(f.config.SharedSecret)
+	}
+	if secret == "" {
+		return errors.New("no secret given and no shared_secret configured")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, sc := range f.servers {
+		if sc.addr == addr {
+			return fmt.Errorf("%s is already a peer", addr)
+		}
+		if peerKey := sc.getPeerKey(); peerKey != nil && ssh.KeysEqual(peerKey, key) {
+			return fmt.Errorf("key already belongs to %s", sc.addr)
+		}
+	}
+	if err := ensureKnownHostsFile(f.config.KnownHostsPath); err != nil {
+		return fmt.Errorf("prepare known_hosts file: %w", err)
+	}
+	if err := addKnownHost(f.config.KnownHostsPath, addr, key); err != nil {
+		return fmt.Errorf("update known_hosts: %w", err)
+	}
+
+	sc := f.newPeer(addr, secret, key)
+	f.servers = append(f.servers, sc)
+	go sc.maintainConnection()
+	log.Printf("Added federation peer %s", addr)
+	return nil
+}
+
+// RemovePeer drops addr and closes its link. Its users disappear as in a
+// netsplit.
+func (f *Federation) RemovePeer(addr string) error {
+	f.mu.Lock()
+	var removed *ServerConnection
+	for i, sc := range f.servers {
+		if sc.addr == addr {
+			removed = sc
+			f.servers = append(f.servers[:i:i], f.servers[i+1:]...)
+			break
+		}
+	}
+	f.mu.Unlock()
+
+	if removed == nil {
+		return errUnknownPeer
+	}
+	close(removed.stop)
+	removed.closeLink()
+	log.Printf("Removed federation peer %s", addr)
+	return nil
+}
+
+// SetPeerDisabled closes the link to addr and keeps it down, or lets it
+// reconnect again.
+func (f *Federation) SetPeerDisabled(addr string, disabled bool) error {
+	sc := f.serverByAddr(addr)
+	if sc == nil {
+		return errUnknownPeer
+	}
+	sc.mu.Lock()
+	sc.disabled = disabled
+	sc.mu.Unlock()
+	if disabled {
+		sc.closeLink()
+	}
+	sc.wakeUp()
+	log.Printf("Federation peer %s disabled: %v", addr, disabled)
+	return nil
+}
+
+// ReconnectPeer drops the current link to addr, if any, and dials again
+// without waiting for the backoff.
+func (f *Federation) ReconnectPeer(addr string) error {
+	sc := f.serverByAddr(addr)
+	if sc == nil {
+		return errUnknownPeer
+	}
+	if sc.isDisabled() {
+		return fmt.Errorf("%s is disabled; enable it first", addr)
+	}
+	sc.closeLink()
+	sc.wakeUp()
+	return nil
+}
+
+// peerConfig returns the federation settings with the peer lists replaced
+// by the current runtime peers.
+func (f *Federation) peerConfig() FederationConfig {
+	fc := f.config
+	fc.Servers, fc.PeerKeys, fc.PeerSecrets, fc.Disabled = nil, nil, nil, nil
+	shared := strings.TrimSpace(fc.SharedSecret)
+	for _, sc := range f.Peers() {
+		fc.Servers = append(fc.Servers, sc.addr)
+		if peerKey := sc.getPeerKey(); peerKey != nil {
+			line := strings.TrimSpace(string(cryptossh.MarshalAuthorizedKey(peerKey)))
+			fc.PeerKeys = append(fc.PeerKeys, sc.addr+"="+line)
+		}
+		if sc.sharedSecret != shared {
+			fc.PeerSecrets = append(fc.PeerSecrets, sc.addr+"="+sc.sharedSecret)
+		}
+		if sc.isDisabled() {
+			fc.Disabled = append(fc.Disabled, sc.addr)
+		}
+	}
+	return fc
+}
+
+// SavePeers writes the current peers back to the ini file at path.
+func (f *Federation) SavePeers(path string) error {
+	return saveFederationPeers(path, f.peerConfig())
+}
+
+// addKnownHost appends a known_hosts line for addr unless it is already there.
+func addKnownHost(path, addr string, key cryptossh.PublicKey) error {
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key)
+	data, err := readFileWithRoot(path)
+	if err != nil {
+		return err
+	}
+	for _, existing := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(existing) == line {
+			return nil
+		}
+	}
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	data = append(data, line+"\n"...)
+	return writeFileWithRoot(path, data, 0600)
+}
+
+func (sc *ServerConnection) isDisabled() bool {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.disabled
+}
+
+func (sc *ServerConnection) isRemoved() bool {
+	select {
+	case <-sc.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// wakeUp interrupts a backoff or disabled wait in maintainConnection.
+func (sc *ServerConnection) wakeUp() {
+	select {
+	case sc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// closeLink closes the active link, inbound or outbound, if there is one.
+func (sc *ServerConnection) closeLink() {
+	sc.mu.RLock()
+	link := sc.link
+	sc.mu.RUnlock()
+	if link != nil {
+		_ = link.Close()
+	}
+}
+
+// waitUntilEnabled blocks while the peer is disabled and reports whether it
+// is still configured.
+func (sc *ServerConnection) waitUntilEnabled() bool {
+	for sc.isDisabled() {
+		sc.setLinkState(linkDisabled, time.Time{})
+		select {
+		case <-sc.wake:
+		case <-sc.stop:
+			return false
+		}
+	}
+	return !sc.isRemoved()
+}
+
+// runFederationCommand executes one admin command for actor and returns its
+// output. Commands that change the peers are written to the audit log;
+// name is how the command was invoked, for the usage line.
+func runFederationCommand(f *Federation, cfg *Config, actor, name string, args []string) string {
+	usage := fmt.Sprintf("Usage: %s %s", name, federationAdminCommands)
+	if len(args) == 0 {
+		return usage
+	}
+
+	audit := func(peer, fingerprint string) {
+		f.hub.auditLog().record(auditEntry{Event: auditPeerChange, Actor: actor, Command: name + " " + args[0], Peer: peer, Fingerprint: fingerprint})
+	}
+	withAddr := func(run func(string) error, done string) string {
+		if len(args) != 2 {
+			return usage
+		}
+		if err := run(args[1]); err != nil {
+			return fmt.Sprintf("%s: %v", args[1], err)
+		}
+		audit(args[1], "")
+		return fmt.Sprintf("%s %s.", args[1], done)
+	}
+
+	switch args[0] {
+	case "list":
+		peers := f.Peers()
+		lines := []string{fmt.Sprintf("Federation peers (%d):", len(peers))}
+		for i, sc := range peers {
+			lines = append(lines, fmt.Sprintf("%d: %s - %s", i+1, sc.addr, formatLinkStatus(sc.Status())))
+		}
+		return strings.Join(lines, "\n")
+	case "add":
+		if len(args) != 4 && len(args) != 5 {
+			return usage
+		}
+		secret := ""
+		if len(args) == 5 {
+			secret = args[4]
+		}
+		if err := f.AddPeer(args[1], args[2]+" "+args[3], secret); err != nil {
+			return fmt.Sprintf("%s: %v", args[1], err)
+		}
+		fingerprint := ""
+		if key, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(args[2] + " " + args[3])); err == nil {
+			fingerprint = cryptossh.FingerprintSHA256(key)
+		}
+		audit(args[1], fingerprint)
+		return fmt.Sprintf("%s added.", args[1])
+	case "remove":
+		return withAddr(f.RemovePeer, "removed")
+	case "disable":
+		return withAddr(func(addr string) error { return f.SetPeerDisabled(addr, true) }, "disabled")
+	case "enable":
+		return withAddr(func(addr string) error { return f.SetPeerDisabled(addr, false) }, "enabled")
+	case "reconnect":
+		return withAddr(f.ReconnectPeer, "reconnecting")
+	case "pending":
+		pending := f.PendingHostKeys()
+		lines := []string{fmt.Sprintf("Host keys awaiting approval (%d):", len(pending))}
+		for _, p := range pending {
+			lines = append(lines, fmt.Sprintf("%s - %s %s, last seen %s ago", p.Addr, p.Key.Type(), p.Fingerprint, time.Since(p.SeenAt).Round(time.Second)))
+		}
+		return strings.Join(lines, "\n")
+	case "approve":
+		if len(args) != 3 {
+			return usage
+		}
+		if err := f.ApproveHostKey(args[1], args[2]); err != nil {
+			return fmt.Sprintf("%s: %v", args[1], err)
+		}
+		audit(args[1], args[2])
+		return fmt.Sprintf("Host key for %s approved.", args[1])
+	case "reject":
+		return withAddr(f.RejectHostKey, "host key rejected")
+	case "save":
+		if cfg == nil || cfg.path == "" {
+			return "No config file to save to."
+		}
+		if err := f.SavePeers(cfg.path); err != nil {
+			return fmt.Sprintf("Saving %s failed: %v", cfg.path, err)
+		}
+		audit("", "")
+		return fmt.Sprintf("Federation peers saved to %s.", cfg.path)
+	default:
+		return usage
+	}
+}
+
+// handleControlSession serves `ssh host fed <command>` for admin keys.
+func handleControlSession(s ssh.Session, f *Federation, cfg *Config) {
+	args := s.Command()
+	if !cfg.isAdminKey(s.PublicKey()) {
+		log.Printf("Rejected control command from %s: key is not an admin key", s.RemoteAddr())
+		fmt.Fprintln(s, "Permission denied.")
+		_ = s.Exit(1)
+		return
+	}
+	if args[0] != "fed" {
+		fmt.Fprintln(s, "Usage: fed "+federationAdminCommands)
+		_ = s.Exit(2)
+		return
+	}
+
+	log.Printf("Control command from %s: %s", s.RemoteAddr(), strings.Join(redactSecret(args[1:]), " "))
+	fmt.Fprintln(s, runFederationCommand(f, cfg, "key "+cryptossh.FingerprintSHA256(s.PublicKey()), "fed", args[1:]))
+	_ = s.Exit(0)
+}
+
+// redactSecret hides the secret argument of `fed add` in logs.
+func redactSecret(args []string) []string {
+	if len(args) == 5 && args[0] == "add" {
+		return append(append([]string(nil), args[:4]...), "<secret>")
+	}
+	return args
+}
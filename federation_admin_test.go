@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+func TestRuntimePeerManagement(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "softroom.ini")
+	knownHosts := filepath.Join(dir, "known_hosts")
+	ini := "[github_auth]\nclient_id = abc\n\n[federation]\n; keep me\nshared_secret = secret\n"
+	if err := os.WriteFile(configPath, []byte(ini), 0600); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	cfg.Federation.KnownHostsPath = knownHosts
+
+	h := newHub()
+	f, err := NewFederation(h, cfg.Federation, nil)
+	if err != nil {
+		t.Fatalf("NewFederation error: %v", err)
+	}
+	h.federation = f
+
+	peerSigner := newTestSigner(t)
+	keyFields := strings.Fields(string(cryptossh.MarshalAuthorizedKey(peerSigner.PublicKey())))
+
+	// Nothing listens on port 1, so the new peer just keeps backing off.
+	addr := "127.0.0.1:1"
+	if got := runFederationCommand(f, cfg, "admin", "/fed", []string{"add", addr, keyFields[0], keyFields[1]}); got != addr+" added." {
+		t.Fatalf("fed add = %q", got)
+	}
+	if got := runFederationCommand(f, cfg, "admin", "/fed", []string{"add", addr, keyFields[0], keyFields[1]}); !strings.Contains(got, "already a peer") {
+		t.Fatalf("adding a peer twice = %q, want an error", got)
+	}
+	if !f.IsPeerKey(peerSigner.PublicKey()) {
+		t.Fatal("an added peer's key should be accepted for inbound links")
+	}
+	hosts, _ := os.ReadFile(knownHosts)
+	if !strings.Contains(string(hosts), keyFields[1]) {
+		t.Fatalf("known_hosts = %q, want the added peer's key", hosts)
+	}
+
+	if got := runFederationCommand(f, cfg, "admin", "/fed", []string{"disable", addr}); got != addr+" disabled." {
+		t.Fatalf("fed disable = %q", got)
+	}
+	if err := f.ReconnectPeer(addr); err == nil {
+		t.Fatal("reconnecting a disabled peer should fail")
+	}
+	if got := runFederationCommand(f, cfg, "admin", "/fed", []string{"save"}); !strings.Contains(got, "saved") {
+		t.Fatalf("fed save = %q", got)
+	}
+
+	saved, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig(saved) error: %v", err)
+	}
+	if len(saved.Federation.Servers) != 1 || saved.Federation.Servers[0] != addr {
+		t.Fatalf("saved servers = %v, want [%s]", saved.Federation.Servers, addr)
+	}
+	if len(saved.Federation.Disabled) != 1 || len(saved.Federation.PeerKeys) != 1 || len(saved.Federation.PeerSecrets) != 0 {
+		t.Fatalf("saved federation = %+v, want one disabled peer with a key and the shared secret", saved.Federation)
+	}
+	if data, _ := os.ReadFile(configPath); !strings.Contains(string(data), "client_id") {
+		t.Fatalf("saving peers should keep the other settings, got %q", data)
+	}
+
+	if got := runFederationCommand(f, cfg, "admin", "/fed", []string{"remove", addr}); got != addr+" removed." {
+		t.Fatalf("fed remove = %q", got)
+	}
+	if len(f.Peers()) != 0 || f.IsPeerKey(peerSigner.PublicKey()) {
+		t.Fatal("a removed peer should be forgotten")
+	}
+	if got := runFederationCommand(f, cfg, "admin", "/fed", []string{"remove", addr}); !strings.Contains(got, "no such federation peer") {
+		t.Fatalf("removing an unknown peer = %q", got)
+	}
+	if got := runFederationCommand(f, cfg, "admin", "/fed", []string{"bogus"}); !strings.HasPrefix(got, "Usage: /fed") {
+		t.Fatalf("unknown subcommand = %q, want usage", got)
+	}
+}
+
+func TestAdminChecks(t *testing.T) {
+	adminSigner := newTestSigner(t)
+	otherSigner := newTestSigner(t)
+
+	cfg := &Config{adminKeys: []cryptossh.PublicKey{adminSigner.PublicKey()}}
+	cfg.Admins.Users = []string{"Octocat"}
+	cfg.Moderators.Users = []string{"hubot", "octocat"}
+
+	if !cfg.isAdminKey(adminSigner.PublicKey()) || cfg.isAdminKey(otherSigner.PublicKey()) {
+		t.Fatal("isAdminKey should only accept listed keys")
+	}
+
+	roles := cfg.roles()
+	if roles["octocat"] != roleAdmin || roles["hubot"] != roleModerator || len(roles) != 2 {
+		t.Fatalf("roles() = %v, want octocat as admin and hubot as moderator", roles)
+	}
+
+	c := &Client{user: "octocat", role: roleAdmin}
+	if isAdmin(c) {
+		t.Fatal("an anonymous user must not be an admin, whatever their nick")
+	}
+	c.SetIsAuthed(true)
+	c.SetRole(roleAdmin)
+	if !isAdmin(c) {
+		t.Fatal("an authenticated listed login should be an admin")
+	}
+	c.SetIsAuthed(false)
+	if c.Role() != "" {
+		t.Fatal("losing GitHub auth should drop the role")
+	}
+	var none *Config
+	if len(none.roles()) != 0 {
+		t.Fatal("a nil config has no roles")
+	}
+}
+
+// newTestSigner returns a signer for a fresh ed25519 key.
+func newTestSigner(t *testing.T) cryptossh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+	signer, err := cryptossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey error: %v", err)
+	}
+	return signer
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Federation links authenticate with a mutual HMAC challenge-response: each
+// side sends a fresh random nonce, and the peer answers with
+// HMAC-SHA256(secret, label | challenge nonce | own nonce). The secret itself
+// never crosses the wire, and every nonce is accepted only once.
+
+type AuthChallengePayload struct {
+	Nonce string `json:"nonce"`
+}
+
+type AuthResponsePayload struct {
+	Nonce string `json:"nonce"` // Responder's own challenge nonce
+	MAC   string `json:"mac"`
+}
+
+const (
+	federationAuthLabel = "softroom-federation-auth-v1"
+	federationNonceSize = 32
+	federationNonceTTL  = 10 * time.Minute
+)
+
+// nonceCache remembers every nonce issued or received recently so that a
+// challenge cannot be replayed or reflected back at its issuer.
+type nonceCache struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	seen map[string]time.Time
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// add records nonce and reports whether it was unseen.
+func (nc *nonceCache) add(nonce string) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	now := time.Now()
+	for n, at := range nc.seen {
+		if now.Sub(at) > nc.ttl {
+			delete(nc.seen, n)
+		}
+	}
+
+	if _, exists := nc.seen[nonce]; exists {
+		return false
+	}
+	nc.seen[nonce] = now
+	return true
+}
+
+func generateNonce() (string, error) {
+	b := make([]byte, federationNonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func federationAuthMAC(secret, challengeNonce, responderNonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(federationAuthLabel + "|" + challengeNonce + "|" + responderNonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isWellFormedNonce(nonce string) bool {
+	b, err := hex.DecodeString(nonce)
+	return err == nil && len(b) == federationNonceSize
+}
+
+// sendAuth starts the handshake by sending a fresh challenge to the peer.
+func (sc *ServerConnection) sendAuth() error {
+	stdin := sc.getConnectionWriter()
+	if stdin == nil {
+		return errors.New("connection writer is not ready")
+	}
+
+	nonce, err := generateNonce()
+	if err != nil {
+		return fmt.Errorf("generate nonce: %w", err)
+	}
+	sc.nonces.add(nonce)
+
+	sc.mu.Lock()
+	sc.localNonce = nonce
+	sc.mu.Unlock()
+
+	b, err := json.Marshal(AuthChallengePayload{Nonce: nonce})
+	if err != nil {
+		return err
+	}
+	return sc.sendRawMessage(stdin, FederationMessage{Type: "auth_challenge", Payload: b})
+}
+
+// answerChallenge proves knowledge of the secret for the peer's nonce.
+func (sc *ServerConnection) answerChallenge(payload AuthChallengePayload) error {
+	if !isWellFormedNonce(payload.Nonce) {
+		return errors.New("malformed challenge nonce")
+	}
+	if !sc.nonces.add(payload.Nonce) {
+		return errors.New("replayed challenge nonce")
+	}
+
+	sc.mu.Lock()
+	if sc.peerNonce != "" {
+		sc.mu.Unlock()
+		return errors.New("duplicate challenge")
+	}
+	sc.peerNonce = payload.Nonce
+	localNonce := sc.localNonce
+	sc.mu.Unlock()
+
+	if localNonce == "" {
+		return errors.New("challenge received before our own challenge was sent")
+	}
+
+	stdin := sc.getConnectionWriter()
+	if stdin == nil {
+		return errors.New("connection writer is not ready")
+	}
+
+	resp := AuthResponsePayload{Nonce: localNonce, MAC: federationAuthMAC(sc.sharedSecret, payload.Nonce, localNonce)}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return sc.sendRawMessage(stdin, FederationMessage{Type: "auth_response", Payload: b})
+}
+
+// verifyResponse checks the peer's answer to our challenge. The local nonce
+// is consumed so a response can be accepted only once.
+func (sc *ServerConnection) verifyResponse(payload AuthResponsePayload) error {
+	sc.mu.Lock()
+	localNonce := sc.localNonce
+	peerNonce := sc.peerNonce
+	sc.localNonce = ""
+	sc.mu.Unlock()
+
+	if localNonce == "" {
+		return errors.New("unexpected auth response")
+	}
+	if peerNonce == "" || payload.Nonce != peerNonce {
+		return errors.New("auth response does not match the peer's challenge")
+	}
+
+	expected := federationAuthMAC(sc.sharedSecret, localNonce, peerNonce)
+	if !hmac.Equal([]byte(expected), []byte(payload.MAC)) {
+		return errors.New("invalid auth response")
+	}
+	return nil
+}
+
+// auditAuthFailure records a failed challenge-response with the peer.
+func (sc *ServerConnection) auditAuthFailure(err error) {
+	sc.hub.auditLog().record(auditEntry{Event: auditFederationAuthErr, Peer: sc.addr, Error: err.Error()})
+}
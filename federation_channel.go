@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/charmbracelet/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// Federation traffic runs on its own SSH channel type instead of a PTY shell,
+// so nothing passes through terminal line discipline. Each message is a JSON
+// document preceded by its length as a 4-byte big-endian integer.
+
+const (
+	federationChannelType   = "softroom-federation"
+	federationMaxFrameSize  = 256 * 1024
+	federationFrameHeadSize = 4
+)
+
+func writeFrame(w io.Writer, payload []byte) error {
+	if len(payload) > federationMaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds limit of %d", len(payload), federationMaxFrameSize)
+	}
+
+	buf := make([]byte, federationFrameHeadSize+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[federationFrameHeadSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var head [federationFrameHeadSize]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(head[:])
+	if size > federationMaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit of %d", size, federationMaxFrameSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
+
+// HandleChannel is registered as the SSH server's handler for the federation
+// channel type. The connection must belong to the federation user and have
+// authenticated with a configured peer key.
+func (f *Federation) HandleChannel(srv *ssh.Server, conn *cryptossh.ServerConn, newChan cryptossh.NewChannel, ctx ssh.Context) {
+	if conn.User() != "federation" {
+		_ = newChan.Reject(cryptossh.Prohibited, "federation channels are reserved for the federation user")
+		return
+	}
+
+	key, _ := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+	sc := f.serverForKey(key)
+	if sc == nil {
+		log.Printf("Rejecting federation channel from %s: public key does not match any configured peer", conn.RemoteAddr())
+		entry := auditEntry{Event: auditFederationReject, Network: remoteIP(conn.RemoteAddr()).String(), Error: "unknown federation peer"}
+		if key != nil {
+			entry.Fingerprint = cryptossh.FingerprintSHA256(key)
+		}
+		f.hub.auditLog().record(entry)
+		_ = newChan.Reject(cryptossh.Prohibited, "unknown federation peer")
+		return
+	}
+	if sc.isDisabled() {
+		log.Printf("Rejecting federation channel from %s: peer is disabled", sc.addr)
+		f.hub.auditLog().record(auditEntry{Event: auditFederationReject, Peer: sc.addr, Error: "federation peer disabled"})
+		_ = newChan.Reject(cryptossh.Prohibited, "federation peer disabled")
+		return
+	}
+
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		log.Printf("Failed to accept federation channel from %s: %v", sc.addr, err)
+		return
+	}
+	go cryptossh.DiscardRequests(reqs)
+
+	log.Printf("Accepted federation channel from %s (%s)", sc.addr, conn.RemoteAddr())
+	if err := sc.serveLink(channel, linkInbound); err != nil {
+		log.Printf("Federation link from %s closed: %v", sc.addr, err)
+		return
+	}
+	log.Printf("Federation link from %s closed", sc.addr)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestE2EChainDirectMessagesAndNetsplit(t *testing.T) {
+	n := newTestNetwork(t, []string{"alpha", "beta", "gamma"}, [2]string{"alpha", "beta"}, [2]string{"beta", "gamma"})
+	n.waitLinked("alpha", "beta")
+	n.waitLinked("beta", "gamma")
+
+	alpha, gamma := n.node("alpha"), n.node("gamma")
+	alice := alpha.join(t, "alice")
+	carol := gamma.join(t, "carol")
+
+	eventually(t, "alpha sees carol through beta", func() bool { return alpha.seesUser("[anon] carol@gamma") })
+	eventually(t, "gamma sees alice through beta", func() bool { return gamma.seesUser("[anon] alice@alpha") })
+
+	alice.say("/w carol hello over two hops")
+	carol.expect("(from [anon] alice@alpha): hello over two hops")
+	alice.expect("(to carol, delivered)")
+
+	alice.say("good morning, everyone")
+	carol.expect("good morning, everyone")
+
+	bob := n.node("beta").join(t, "bob")
+	n.split("beta", "gamma")
+	bob.expect("Netsplit: lost link to " + gamma.addr + ". Left: carol")
+	eventually(t, "carol is gone from alpha", func() bool { return !alpha.seesUser("[anon] carol@gamma") })
+
+	alice.say("/w carol are you there?")
+	alice.expect("User 'carol' not found.")
+
+	n.heal("beta", "gamma")
+	n.waitLinked("beta", "gamma")
+	eventually(t, "carol is back on alpha", func() bool { return alpha.seesUser("[anon] carol@gamma") })
+}
+
+func TestE2EReconnectAfterLinkDrop(t *testing.T) {
+	n := newTestNetwork(t, []string{"alpha", "beta"}, [2]string{"alpha", "beta"})
+	n.waitLinked("alpha", "beta")
+
+	alpha, beta := n.node("alpha"), n.node("beta")
+	bob := beta.join(t, "bob")
+	eventually(t, "alpha sees bob", func() bool { return alpha.seesUser("[anon] bob@beta") })
+
+	// Drop the connection without disabling the peer; it must come back by itself.
+	linkedAt := alpha.peer(beta).lastAuthenticatedAt()
+	alpha.peer(beta).closeLink()
+	eventually(t, "the link is re-established", func() bool {
+		return alpha.peer(beta).lastAuthenticatedAt().After(linkedAt)
+	})
+	n.waitLinked("alpha", "beta")
+	eventually(t, "alpha sees bob again", func() bool { return alpha.seesUser("[anon] bob@beta") })
+
+	alice := alpha.join(t, "alice")
+	alice.say("/w bob@beta welcome back")
+	bob.expect("welcome back")
+}
+
+func TestE2ENameConflictAfterNetsplit(t *testing.T) {
+	n := newTestNetwork(t, []string{"alpha", "beta"}, [2]string{"alpha", "beta"})
+	n.waitLinked("alpha", "beta")
+	n.split("alpha", "beta")
+
+	alpha, beta := n.node("alpha"), n.node("beta")
+	onAlpha := alpha.join(t, "dave")
+	onBeta := beta.join(t, "dave")
+
+	n.heal("alpha", "beta")
+	n.waitLinked("alpha", "beta")
+
+	// Exactly one of the two is renamed, and both servers agree on who.
+	renamed := func(u *testUser) bool { return strings.HasPrefix(u.client.User(), "dave-") }
+	eventually(t, "the conflict is settled", func() bool { return renamed(onAlpha) != renamed(onBeta) })
+	loser, winner := onAlpha, onBeta
+	if renamed(onBeta) {
+		loser, winner = onBeta, onAlpha
+	}
+	loser.expect(loser.client.User())
+
+	for _, node := range []*testNode{alpha, beta} {
+		eventually(t, node.name+" lists both users once", func() bool {
+			users := node.users()
+			return len(users) == 2 &&
+				containsSuffix(users, "dave@"+winner.node.name, "dave") &&
+				containsSuffix(users, loser.client.User()+"@"+loser.node.name, loser.client.User())
+		})
+	}
+}
+
+// containsSuffix reports whether users lists a label ending in remote or
+// exactly matching local, ignoring the [anon] marker.
+func containsSuffix(users []string, remote, local string) bool {
+	for _, label := range users {
+		name := strings.TrimPrefix(label, "[anon] ")
+		if name == remote || name == local {
+			return true
+		}
+	}
+	return false
+}
+
+func TestE2EModerationFollowsPeerTrust(t *testing.T) {
+	n := newTestNetworkWith(t, func(n *testNetwork) {
+		alpha, beta, gamma := n.node("alpha"), n.node("beta"), n.node("gamma")
+		alpha.cfg.Federation.ModerationTrust = []string{beta.addr + "=ban"}
+		gamma.cfg.Federation.ModerationTrust = []string{beta.addr + "=kick"}
+	}, []string{"alpha", "beta", "gamma"}, [2]string{"alpha", "beta"}, [2]string{"beta", "gamma"})
+	n.waitLinked("alpha", "beta")
+	n.waitLinked("beta", "gamma")
+
+	troll := n.node("alpha").join(t, "troll", withFingerprint("SHA256:troll"))
+	other := n.node("gamma").join(t, "troll2", withFingerprint("SHA256:troll"))
+
+	beta := n.node("beta")
+	beta.hub.moderate(moderationAction{Action: moderationBan, Issuer: "mod", Fingerprint: "SHA256:troll", Reason: "spam"})
+	troll.expect("You have been banned by mod@beta: spam.")
+
+	// gamma only trusts beta with kicks: the ban is relayed there but not
+	// applied, so the first notice the user gets is the kick that follows.
+	beta.hub.moderate(moderationAction{Action: moderationKick, Issuer: "mod", Fingerprint: "SHA256:troll"})
+	if msg := other.expect("You have been"); !strings.Contains(msg.Content, "kicked") {
+		t.Fatalf("troll2 on gamma got %q, want only the kick applied", msg.Content)
+	}
+}
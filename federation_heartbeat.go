@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+)
+
+// Each authenticated link is probed with ping/pong. Any frame from the peer
+// counts as a sign of life; when heartbeatMisses pings in a row go
+// unanswered the link is closed, which also unblocks any stuck writes.
+
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultHeartbeatMisses   = 3
+)
+
+type PingPayload struct {
+	SentAt int64 `json:"sent_at"` // Unix nanoseconds, echoed back in the pong
+}
+
+func (sc *ServerConnection) recordActivity() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.lastSeen = time.Now()
+	sc.missedBeats = 0
+}
+
+func (sc *ServerConnection) recordPong(payload PingPayload) {
+	rtt := time.Since(time.Unix(0, payload.SentAt))
+	if rtt < 0 {
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.rtt = rtt
+}
+
+// missBeat counts an unanswered ping and reports whether the link is dead.
+func (sc *ServerConnection) missBeat() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.missedBeats++
+	return sc.missedBeats > sc.heartbeatMisses
+}
+
+// runHeartbeat pings the peer until done is closed, closing channel once the
+// peer has missed too many heartbeats.
+func (sc *ServerConnection) runHeartbeat(channel io.Closer, done <-chan struct{}) {
+	ticker := time.NewTicker(sc.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !sc.isAuthenticated() || !sc.supports("heartbeat") {
+				continue
+			}
+			if sc.missBeat() {
+				log.Printf("Federation peer %s missed %d heartbeats; closing link", sc.addr, sc.heartbeatMisses)
+				_ = channel.Close()
+				return
+			}
+			sc.sendPing()
+		}
+	}
+}
+
+func (sc *ServerConnection) sendPing() {
+	stdin := sc.getConnectionWriter()
+	if stdin == nil {
+		return
+	}
+
+	b, err := json.Marshal(PingPayload{SentAt: time.Now().UnixNano()})
+	if err != nil {
+		log.Printf("Failed to marshal ping payload: %v", err)
+		return
+	}
+	if err := sc.queueMessage(stdin, FederationMessage{Type: "ping", Payload: b}); err != nil {
+		log.Printf("Failed to send ping to %s: %v", sc.addr, err)
+	}
+}
+
+func (sc *ServerConnection) sendPong(payload json.RawMessage) {
+	stdin := sc.getConnectionWriter()
+	if stdin == nil {
+		return
+	}
+	if err := sc.queueMessage(stdin, FederationMessage{Type: "pong", Payload: payload}); err != nil {
+		log.Printf("Failed to send pong to %s: %v", sc.addr, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// After authenticating, both sides send a hello describing their protocol
+// version and the message types they understand. Senders consult the peer's
+// capabilities before emitting any optional message type.
+
+const (
+	federationProtocolVersion    = 1
+	federationMinProtocolVersion = 1
+)
+
+// softwareVersion is overridden at build time with -ldflags "-X main.softwareVersion=...".
+var softwareVersion = "dev"
+
+// localCapabilities lists the federation message types this server handles.
+var localCapabilities = []string{
+	"nick_sync",
+	"private_message",
+	"public_message",
+	"name_change",
+	"user_delta",
+	"heartbeat",
+	"private_message_ack",
+	"moderation_action",
+}
+
+// legacyCapabilities is assumed for a peer until its hello arrives.
+var legacyCapabilities = []string{
+	"nick_sync",
+	"private_message",
+	"name_change",
+}
+
+type HelloPayload struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	ServerID        string   `json:"server_id"`
+	ServerName      string   `json:"server_name,omitempty"`
+	SoftwareVersion string   `json:"software_version"`
+	Capabilities    []string `json:"capabilities"`
+}
+
+type peerInfo struct {
+	ProtocolVersion int
+	ServerID        string
+	ServerName      string
+	SoftwareVersion string
+	Capabilities    map[string]bool
+}
+
+// serverIDFromSigner derives a stable server ID from the host key.
+func serverIDFromSigner(signer cryptossh.Signer) string {
+	if signer == nil {
+		return ""
+	}
+	return serverIDFromKey(signer.PublicKey())
+}
+
+// serverIDFromKey is the server ID of the server with host key key.
+func serverIDFromKey(key cryptossh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return hex.EncodeToString(sum[:8])
+}
+
+func (sc *ServerConnection) sendHello() error {
+	stdin := sc.getConnectionWriter()
+	if stdin == nil {
+		return errors.New("connection writer is not ready")
+	}
+
+	payload := HelloPayload{
+		ProtocolVersion: federationProtocolVersion,
+		ServerID:        sc.localID,
+		ServerName:      sc.localName,
+		SoftwareVersion: softwareVersion,
+		Capabilities:    localCapabilities,
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return sc.sendRawMessage(stdin, FederationMessage{Type: "hello", Payload: b})
+}
+
+func (sc *ServerConnection) handleHello(payload HelloPayload) error {
+	if payload.ProtocolVersion < federationMinProtocolVersion {
+		return fmt.Errorf("peer protocol version %d is older than the minimum %d", payload.ProtocolVersion, federationMinProtocolVersion)
+	}
+
+	caps := make(map[string]bool, len(payload.Capabilities))
+	for _, c := range payload.Capabilities {
+		caps[c] = true
+	}
+
+	name := normalizeServerName(payload.ServerName)
+	if !isValidServerName(name) {
+		name = ""
+	}
+	if name != "" && name == sc.localName {
+		log.Printf("Warning: federation peer %s uses our own server name %q", sc.addr, name)
+	}
+
+	sc.mu.Lock()
+	sc.peer = &peerInfo{
+		ProtocolVersion: payload.ProtocolVersion,
+		ServerID:        payload.ServerID,
+		ServerName:      name,
+		SoftwareVersion: payload.SoftwareVersion,
+		Capabilities:    caps,
+	}
+	sc.mu.Unlock()
+
+	// Capabilities are known now, so send the first snapshot.
+	sc.hub.requestNickSnapshot(sc, true)
+
+	log.Printf("Federation peer %s is %s (protocol %d, server ID %s, capabilities: %v)", sc.addr, payload.SoftwareVersion, payload.ProtocolVersion, payload.ServerID, payload.Capabilities)
+	return nil
+}
+
+// peerID returns the server ID the peer sent in its hello.
+func (sc *ServerConnection) peerID() string {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	if sc.peer == nil {
+		return ""
+	}
+	return sc.peer.ServerID
+}
+
+// peerName returns the name the peer sent in its hello, falling back to its
+// server ID and then to the configured address for older peers.
+func (sc *ServerConnection) peerName() string {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	if sc.peer != nil && sc.peer.ServerName != "" {
+		return sc.peer.ServerName
+	}
+	if sc.peer != nil && sc.peer.ServerID != "" {
+		return sc.peer.ServerID
+	}
+	return sc.addr
+}
+
+// supports reports whether the peer has advertised msgType.
+func (sc *ServerConnection) supports(msgType string) bool {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	if sc.peer == nil {
+		for _, c := range legacyCapabilities {
+			if c == msgType {
+				return true
+			}
+		}
+		return false
+	}
+	return sc.peer.Capabilities[msgType]
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// Kicks, mutes and bans are flooded to the federation as moderation_action
+// messages signed with the issuing server's host key. A server acts on one
+// only if the issuer is a direct peer, the signature matches that peer's
+// configured key, and its moderation_trust setting covers the action.
+// Actions are relayed whether or not they are applied, so servers further
+// away can make their own decision.
+
+const (
+	moderationTrustNone = "none"
+	moderationTrustKick = "kick"
+	moderationTrustMute = "mute"
+	moderationTrustBan  = "ban"
+)
+
+// moderationLevels orders trust settings and the actions they cover: a peer
+// trusted at one level may issue the action of that level and any below.
+var moderationLevels = map[string]int{
+	moderationTrustNone: 0,
+	moderationTrustKick: 1,
+	moderationTrustMute: 2,
+	moderationTrustBan:  3,
+}
+
+// moderationClockSkew is how far a peer's clock may run ahead of ours. An
+// action is accepted while it is younger than seenMessageTTL less the skew,
+// so a replay always arrives while its ID is still remembered.
+const moderationClockSkew = 30 * time.Second
+
+type ModerationActionPayload struct {
+	ID          string `json:"id"`
+	Action      string `json:"action"`
+	Issuer      string `json:"issuer"`
+	Server      string `json:"server,omitempty"`      // Name of the issuing server
+	Login       string `json:"login,omitempty"`       // GitHub login of the target
+	Fingerprint string `json:"fingerprint,omitempty"` // SSH key fingerprint of the target
+	Reason      string `json:"reason,omitempty"`
+	Expires     int64  `json:"expires,omitempty"` // Unix seconds, 0 for none
+	IssuedAt    int64  `json:"issued_at"`
+	SignerKey   string `json:"signer_key"` // Issuing server's host key, authorized_keys format
+	Signature   []byte `json:"signature"`
+	Hops        int    `json:"hops,omitempty"`
+}
+
+type remoteModerationRequest struct {
+	serverAddr string
+	payload    ModerationActionPayload
+}
+
+// signedBytes is the part of the payload covered by the signature; the hop
+// counter changes on every relay and is left out.
+func (p ModerationActionPayload) signedBytes() []byte {
+	p.Signature = nil
+	p.Hops = 0
+	b, _ := json.Marshal(p)
+	return b
+}
+
+func (p ModerationActionPayload) action() moderationAction {
+	action := moderationAction{
+		ID:          p.ID,
+		Action:      p.Action,
+		Issuer:      p.Issuer,
+		Server:      p.Server,
+		Login:       p.Login,
+		Fingerprint: p.Fingerprint,
+		Reason:      p.Reason,
+	}
+	if p.Expires != 0 {
+		action.Expires = time.Unix(p.Expires, 0)
+	}
+	return action
+}
+
+// signModeration builds the signed payload for an action issued here.
+func signModeration(action moderationAction, signer cryptossh.Signer) (ModerationActionPayload, error) {
+	if signer == nil {
+		return ModerationActionPayload{}, errors.New("no host key to sign with")
+	}
+	payload := ModerationActionPayload{
+		ID:          action.ID,
+		Action:      action.Action,
+		Issuer:      action.Issuer,
+		Server:      action.Server,
+		Login:       action.Login,
+		Fingerprint: action.Fingerprint,
+		Reason:      action.Reason,
+		IssuedAt:    time.Now().Unix(),
+		SignerKey:   strings.TrimSpace(string(cryptossh.MarshalAuthorizedKey(signer.PublicKey()))),
+		Hops:        1,
+	}
+	if !action.Expires.IsZero() {
+		payload.Expires = action.Expires.Unix()
+	}
+	sig, err := signer.Sign(rand.Reader, payload.signedBytes())
+	if err != nil {
+		return ModerationActionPayload{}, err
+	}
+	payload.Signature = cryptossh.Marshal(sig)
+	return payload, nil
+}
+
+// verifyModeration checks the payload's signature and returns the key that
+// made it.
+func verifyModeration(payload ModerationActionPayload) (cryptossh.PublicKey, error) {
+	key, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(payload.SignerKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer key: %w", err)
+	}
+	var sig cryptossh.Signature
+	if err := cryptossh.Unmarshal(payload.Signature, &sig); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	if err := key.Verify(payload.signedBytes(), &sig); err != nil {
+		return nil, fmt.Errorf("bad signature: %w", err)
+	}
+	return key, nil
+}
+
+// checkIssuedAt refuses actions stamped in the future, beyond clock skew,
+// and actions too old for a replay to be caught by their ID.
+func checkIssuedAt(issuedAt int64, now time.Time) error {
+	issued := time.Unix(issuedAt, 0)
+	if issued.After(now.Add(moderationClockSkew)) {
+		return fmt.Errorf("issued %s in the future", issued.Sub(now).Round(time.Second))
+	}
+	if age := now.Sub(issued); age > seenMessageTTL-moderationClockSkew {
+		return fmt.Errorf("issued %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+// trustsModeration reports whether level allows a peer to issue action.
+func trustsModeration(level, action string) bool {
+	return moderationLevels[level] > 0 && moderationLevels[level] >= moderationLevels[action]
+}
+
+// BroadcastModeration signs an action issued on this server and sends it to
+// every peer.
+func (f *Federation) BroadcastModeration(action moderationAction) {
+	if action.Server == "" {
+		action.Server = f.serverName
+	}
+	payload, err := signModeration(action, f.signer)
+	if err != nil {
+		log.Printf("Not sending moderation action %s: %v", action.ID, err)
+		return
+	}
+	f.relayModeration(payload, "")
+}
+
+// relayModeration sends payload to every peer except the one at except.
+func (f *Federation) relayModeration(payload ModerationActionPayload, except string) {
+	for _, sc := range f.Peers() {
+		if sc.addr == except {
+			continue
+		}
+		sc.sendModerationAction(payload)
+	}
+}
+
+func (sc *ServerConnection) sendModerationAction(payload ModerationActionPayload) {
+	if !sc.isAuthenticated() || !sc.supports("moderation_action") {
+		return
+	}
+	stdin := sc.getConnectionWriter()
+	if stdin == nil {
+		return
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to marshal moderation_action payload: %v", err)
+		return
+	}
+	if err := sc.queueMessage(stdin, FederationMessage{Type: "moderation_action", Payload: b}); err != nil {
+		log.Printf("Failed to send moderation action via %s: %v", sc.addr, err)
+	}
+}
+
+// handleRemoteModeration verifies, relays and, if the issuer is trusted,
+// applies an action received from a peer.
+func (h *Hub) handleRemoteModeration(req remoteModerationRequest) {
+	payload := req.payload
+	if !isModerationAction(payload.Action) || (payload.Login == "" && payload.Fingerprint == "") {
+		log.Printf("Ignoring malformed moderation action from %s", req.serverAddr)
+		return
+	}
+	key, err := verifyModeration(payload)
+	if err == nil {
+		err = checkIssuedAt(payload.IssuedAt, time.Now())
+	}
+	if err != nil {
+		log.Printf("Ignoring moderation action from %s: %v", req.serverAddr, err)
+		return
+	}
+	if !h.markSeen(payload.ID) {
+		return
+	}
+	if payload.Hops < federationMaxHops {
+		relayed := payload
+		relayed.Hops++
+		h.federation.relayModeration(relayed, req.serverAddr)
+	}
+
+	issuer := h.federation.serverForKey(key)
+	if issuer == nil {
+		log.Printf("Ignoring moderation action %s by %s@%s: issuer is not a direct peer", payload.ID, payload.Issuer, payload.Server)
+		return
+	}
+	if !trustsModeration(issuer.moderationTrust, payload.Action) {
+		log.Printf("Ignoring %s by %s@%s: moderation_trust for %s is %q", payload.Action, payload.Issuer, payload.Server, issuer.addr, issuer.moderationTrust)
+		return
+	}
+	log.Printf("Applying %s by %s@%s from %s", payload.Action, payload.Issuer, payload.Server, issuer.addr)
+	h.applyRemoteModeration(payload.action())
+}
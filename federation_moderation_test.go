@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+func TestModerationActionSignature(t *testing.T) {
+	signer := newTestSigner(t)
+
+	payload, err := signModeration(moderationAction{ID: "m1", Action: moderationMute, Issuer: "mod", Login: "troll", Reason: "spam"}, signer)
+	if err != nil {
+		t.Fatalf("signModeration error: %v", err)
+	}
+
+	// The payload survives the wire and relaying, which bumps the hop count.
+	b, _ := json.Marshal(payload)
+	var received ModerationActionPayload
+	if err := json.Unmarshal(b, &received); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	received.Hops = 3
+	key, err := verifyModeration(received)
+	if err != nil {
+		t.Fatalf("verifyModeration error: %v", err)
+	}
+	if string(key.Marshal()) != string(signer.PublicKey().Marshal()) {
+		t.Fatal("verifyModeration returned the wrong key")
+	}
+
+	received.Reason = "no reason"
+	if _, err := verifyModeration(received); err == nil {
+		t.Fatal("a modified action must fail verification")
+	}
+	if _, err := signModeration(moderationAction{ID: "m2", Action: moderationKick}, nil); err == nil {
+		t.Fatal("signing without a host key should fail")
+	}
+}
+
+func TestCheckIssuedAt(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name   string
+		issued time.Time
+		ok     bool
+	}{
+		{"now", now, true},
+		{"slightly fast clock", now.Add(moderationClockSkew / 2), true},
+		{"future", now.Add(time.Hour), false},
+		{"recent", now.Add(-seenMessageTTL / 2), true},
+		{"forgotten ID", now.Add(-seenMessageTTL), false},
+	}
+	for _, tc := range cases {
+		if err := checkIssuedAt(tc.issued.Unix(), now); (err == nil) != tc.ok {
+			t.Errorf("%s: checkIssuedAt error = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestTrustsModeration(t *testing.T) {
+	cases := []struct {
+		level, action string
+		want          bool
+	}{
+		{moderationTrustNone, moderationKick, false},
+		{"", moderationKick, false},
+		{moderationTrustKick, moderationKick, true},
+		{moderationTrustKick, moderationMute, false},
+		{moderationTrustMute, moderationMute, true},
+		{moderationTrustMute, moderationBan, false},
+		{moderationTrustBan, moderationBan, true},
+	}
+	for _, tc := range cases {
+		if got := trustsModeration(tc.level, tc.action); got != tc.want {
+			t.Errorf("trustsModeration(%q, %q) = %v, want %v", tc.level, tc.action, got, tc.want)
+		}
+	}
+}
+
+func TestHandleRemoteModeration(t *testing.T) {
+	h := newHub()
+	h.federation = &Federation{hub: h, serverID: "B", nonces: newNonceCache(federationNonceTTL)}
+
+	issuerSigner := newTestSigner(t)
+	issuer := NewServerConnection("a:22", h, "", "secret")
+	issuer.peerKey = issuerSigner.PublicKey()
+	issuer.setConnection(&bytes.Buffer{})
+	issuer.setAuthenticated(true)
+
+	relayOut := &bytes.Buffer{}
+	next := NewServerConnection("c:22", h, "", "secret")
+	next.setConnection(relayOut)
+	next.setAuthenticated(true)
+	next.peer = &peerInfo{ServerID: "C", Capabilities: map[string]bool{"moderation_action": true}}
+	h.federation.servers = append(h.federation.servers, issuer, next)
+
+	troll := &Client{user: "troll", send: make(chan Message, 10), fingerprint: "SHA256:troll"}
+	h.clients[troll] = true
+	h.clientsByName["troll"] = troll
+
+	kick := func(id string) remoteModerationRequest {
+		payload, err := signModeration(moderationAction{ID: id, Action: moderationKick, Issuer: "mod", Server: "alpha", Fingerprint: "SHA256:troll"}, issuerSigner)
+		if err != nil {
+			t.Fatalf("signModeration error: %v", err)
+		}
+		return remoteModerationRequest{serverAddr: "a:22", payload: payload}
+	}
+
+	h.handleRemoteModeration(kick("k1"))
+	if troll.kickReason != "" {
+		t.Fatal("a peer with no moderation_trust must not kick local users")
+	}
+	if !strings.Contains(relayOut.String(), "moderation_action") {
+		t.Fatal("actions should be relayed even when not applied here")
+	}
+
+	issuer.moderationTrust = moderationTrustKick
+	h.handleRemoteModeration(kick("k2"))
+	if msg := <-troll.send; !strings.Contains(msg.Content, "You have been kicked by mod@alpha") {
+		t.Fatalf("troll got %q, want a kick notice", msg.Content)
+	}
+	if troll.kickReason == "" {
+		t.Fatal("a trusted kick should disconnect the user")
+	}
+
+	// Once the window has passed the hub no longer remembers k2, so the
+	// replay is caught by its age alone.
+	replay := kick("k2")
+	replay.payload.IssuedAt = time.Now().Add(-seenMessageTTL - time.Minute).Unix()
+	sig, err := issuerSigner.Sign(rand.Reader, replay.payload.signedBytes())
+	if err != nil {
+		t.Fatalf("Sign error: %v", err)
+	}
+	replay.payload.Signature = cryptossh.Marshal(sig)
+	h.seenMessages = newNonceCache(seenMessageTTL)
+	troll.kickReason = ""
+	relayOut.Reset()
+	h.handleRemoteModeration(replay)
+	if troll.kickReason != "" || len(troll.send) != 0 {
+		t.Fatal("a replayed action from outside the window must not be applied")
+	}
+	if relayOut.Len() != 0 {
+		t.Fatal("a replayed action from outside the window must not be relayed")
+	}
+
+	forged := kick("k3")
+	forged.payload.Fingerprint = "SHA256:someone-else"
+	relayOut.Reset()
+	h.handleRemoteModeration(forged)
+	if relayOut.Len() != 0 {
+		t.Fatal("actions with a bad signature must not be relayed")
+	}
+}
+
+func TestRemoteModerationSparesLocalStaff(t *testing.T) {
+	h := newHub()
+	h.federation = &Federation{hub: h, serverID: "B", nonces: newNonceCache(federationNonceTTL)}
+	h.roles = map[string]string{"boss": roleAdmin, "away": roleModerator}
+
+	issuerSigner := newTestSigner(t)
+	issuer := NewServerConnection("a:22", h, "", "secret")
+	issuer.peerKey = issuerSigner.PublicKey()
+	issuer.moderationTrust = moderationTrustBan
+	h.federation.servers = append(h.federation.servers, issuer)
+
+	join := func(name, role, fingerprint string) *Client {
+		c := &Client{user: name, send: make(chan Message, 10), fingerprint: fingerprint}
+		c.SetIsAuthed(true)
+		c.SetRole(role)
+		h.clients[c] = true
+		h.clientsByName[name] = c
+		return c
+	}
+	boss := join("boss", roleAdmin, "SHA256:shared")
+	troll := join("troll", "", "SHA256:shared")
+
+	ban := func(id string, action moderationAction) remoteModerationRequest {
+		action.ID, action.Action, action.Issuer, action.Server = id, moderationBan, "mod", "alpha"
+		payload, err := signModeration(action, issuerSigner)
+		if err != nil {
+			t.Fatalf("signModeration error: %v", err)
+		}
+		return remoteModerationRequest{serverAddr: "a:22", payload: payload}
+	}
+
+	h.handleRemoteModeration(ban("b1", moderationAction{Login: "boss"}))
+	if boss.kickReason != "" {
+		t.Fatal("a remote ban must not disconnect a local admin")
+	}
+
+	h.handleRemoteModeration(ban("b2", moderationAction{Fingerprint: "SHA256:shared"}))
+	if boss.kickReason != "" {
+		t.Fatal("a remote ban must not disconnect a local admin with a banned key")
+	}
+	if troll.kickReason == "" {
+		t.Fatal("a remote ban should still disconnect the other users it matches")
+	}
+
+	// An offline moderator is recognised by their configured role.
+	h.handleRemoteModeration(ban("b3", moderationAction{Login: "away"}))
+	if got := h.bans.active(); len(got) != 0 {
+		t.Fatalf("remote bans matching local staff should not be kept, got %+v", got)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Nick lists are kept in sync with user_join/user_leave deltas, each carrying
+// a per-link sequence number. A full nick_sync snapshot is sent when a link
+// comes up, when the receiver detects a sequence gap, or when the periodic
+// nick_checksum shows the receiver's copy has drifted.
+
+const nickChecksumInterval = 30 * time.Second
+
+type UserDeltaPayload struct {
+	Nick     string   `json:"nick"`
+	Path     []string `json:"path,omitempty"`   // Server IDs to the user's home server
+	Server   string   `json:"server,omitempty"` // Name of the user's home server
+	Clock    uint64   `json:"clock,omitempty"`
+	Authed   bool     `json:"authed,omitempty"`
+	Provider string   `json:"provider,omitempty"`
+	Seq      uint64   `json:"seq"`
+}
+
+// NickClaim is the claim on a nick sent with every advertised user.
+type NickClaim struct {
+	Clock    uint64 `json:"clock"`
+	Authed   bool   `json:"authed,omitempty"`
+	Provider string `json:"provider,omitempty"` // Auth provider of a verified user
+}
+
+func (p UserDeltaPayload) route() nickRoute {
+	return nickRoute{Path: p.Path, Server: normalizeServerName(p.Server), Clock: p.Clock, Authed: p.Authed, Provider: p.Provider}
+}
+
+// routes returns the advertised route of every nick, keyed as sent.
+func (p NickSyncPayload) routes() map[string]nickRoute {
+	routes := make(map[string]nickRoute, len(p.Nicks))
+	for _, nick := range p.Nicks {
+		claim := p.Claims[nick]
+		routes[nick] = nickRoute{Path: p.Paths[nick], Server: normalizeServerName(p.Servers[nick]), Clock: claim.Clock, Authed: claim.Authed, Provider: claim.Provider}
+	}
+	return routes
+}
+
+type NickChecksumPayload struct {
+	Seq      uint64 `json:"seq"`
+	Checksum string `json:"checksum"`
+}
+
+// nickChecksum is independent of list order.
+func nickChecksum(nicks []string) string {
+	sorted := make([]string, 0, len(nicks))
+	for _, n := range nicks {
+		sorted = append(sorted, normalizeUsername(n))
+	}
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (sc *ServerConnection) nextOutSeq() uint64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.outSeq++
+	return sc.outSeq
+}
+
+func (sc *ServerConnection) currentOutSeq() uint64 {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.outSeq
+}
+
+func (sc *ServerConnection) currentInSeq() uint64 {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.inSeq
+}
+
+func (sc *ServerConnection) resetInSeq(seq uint64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.inSeq = seq
+}
+
+// advanceInSeq records seq and reports whether it directly followed the
+// previous one.
+func (sc *ServerConnection) advanceInSeq(seq uint64) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	inOrder := seq == sc.inSeq+1
+	sc.inSeq = seq
+	return inOrder
+}
+
+// startNickSync periodically sends a checksum of our local nicks until done
+// is closed. Peers without delta support get a full snapshot instead.
+func (sc *ServerConnection) startNickSync(done <-chan struct{}) {
+	ticker := time.NewTicker(nickChecksumInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if sc.isAuthenticated() {
+				sc.hub.requestNickSnapshot(sc, false)
+			}
+		}
+	}
+}
+
+// sendNickSync sends a full snapshot. It must be called from the hub
+// goroutine so that the snapshot and the deltas are ordered consistently.
+func (sc *ServerConnection) sendNickSync(nicks []string, routes map[string]nickRoute) {
+	if !sc.isAuthenticated() || !sc.supports("nick_sync") {
+		return
+	}
+
+	stdin := sc.getConnectionWriter()
+	if stdin == nil {
+		log.Printf("Skipping nick sync for %s: connection is not ready", sc.addr)
+		return
+	}
+
+	paths := make(map[string][]string, len(routes))
+	servers := make(map[string]string, len(routes))
+	claims := make(map[string]NickClaim, len(routes))
+	for nick, route := range routes {
+		paths[nick] = route.Path
+		servers[nick] = route.Server
+		claims[nick] = NickClaim{Clock: route.Clock, Authed: route.Authed, Provider: route.Provider}
+	}
+
+	payload := NickSyncPayload{Nicks: nicks, Paths: paths, Servers: servers, Claims: claims, Seq: sc.currentOutSeq(), Checksum: nickChecksum(nicks)}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to marshal nick_sync payload: %v", err)
+		return
+	}
+
+	if err := sc.queueMessage(stdin, FederationMessage{Type: "nick_sync", Payload: b}); err != nil {
+		log.Printf("Failed to send nick sync to %s: %v", sc.addr, err)
+	}
+}
+
+// sendNickChecksum must be called from the hub goroutine, like sendNickSync.
+func (sc *ServerConnection) sendNickChecksum(nicks []string) {
+	if !sc.isAuthenticated() {
+		return
+	}
+
+	stdin := sc.getConnectionWriter()
+	if stdin == nil {
+		return
+	}
+
+	b, err := json.Marshal(NickChecksumPayload{Seq: sc.currentOutSeq(), Checksum: nickChecksum(nicks)})
+	if err != nil {
+		log.Printf("Failed to marshal nick_checksum payload: %v", err)
+		return
+	}
+
+	if err := sc.queueMessage(stdin, FederationMessage{Type: "nick_checksum", Payload: b}); err != nil {
+		log.Printf("Failed to send nick checksum to %s: %v", sc.addr, err)
+	}
+}
+
+func (sc *ServerConnection) sendUserDelta(msgType, nick string, route nickRoute) {
+	if !sc.isAuthenticated() || !sc.supports("user_delta") {
+		return
+	}
+
+	stdin := sc.getConnectionWriter()
+	if stdin == nil {
+		return
+	}
+
+	b, err := json.Marshal(UserDeltaPayload{Nick: nick, Path: route.Path, Server: route.Server, Clock: route.Clock, Authed: route.Authed, Provider: route.Provider, Seq: sc.nextOutSeq()})
+	if err != nil {
+		log.Printf("Failed to marshal %s payload: %v", msgType, err)
+		return
+	}
+
+	if err := sc.queueMessage(stdin, FederationMessage{Type: msgType, Payload: b}); err != nil {
+		log.Printf("Failed to send %s to %s: %v", msgType, sc.addr, err)
+	}
+}
+
+func (sc *ServerConnection) sendNickSyncRequest() {
+	stdin := sc.getConnectionWriter()
+	if stdin == nil {
+		return
+	}
+
+	if err := sc.queueMessage(stdin, FederationMessage{Type: "nick_sync_request", Payload: json.RawMessage("{}")}); err != nil {
+		log.Printf("Failed to request nick sync from %s: %v", sc.addr, err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Frames for a peer go through a bounded queue drained by a per-link writer
+// goroutine, so a slow or stuck peer never blocks the hub. When the queue is
+// full, droppable frames are discarded; anything else would leave the peer
+// with a diverging view, so the link is closed and resynced on reconnect.
+
+const defaultOutboundQueueSize = 256
+
+var errOutboundQueueFull = errors.New("outbound queue full")
+
+// droppableMessages are either periodic or safe to lose: public messages are
+// best-effort, checksums and heartbeats are resent on the next tick.
+var droppableMessages = map[string]bool{
+	"public_message": true,
+	"nick_checksum":  true,
+	"ping":           true,
+	"pong":           true,
+}
+
+// startWriter attaches a fresh queue to the link and drains it until done is
+// closed or a write fails.
+func (sc *ServerConnection) startWriter(channel io.WriteCloser, done <-chan struct{}) {
+	queue := make(chan []byte, sc.queueSize)
+
+	sc.mu.Lock()
+	sc.outbound = queue
+	sc.link = channel
+	sc.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case frame := <-queue:
+				sc.writeMu.Lock()
+				err := writeFrame(channel, frame)
+				sc.writeMu.Unlock()
+				if err != nil {
+					log.Printf("Federation writer for %s stopped: %v", sc.addr, err)
+					_ = channel.Close()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// queueMessage hands msg to the link's writer without blocking. Without a
+// writer (before the link is served) it falls back to a direct write.
+func (sc *ServerConnection) queueMessage(stdin io.Writer, msg FederationMessage) error {
+	sc.mu.Lock()
+	queue, link := sc.outbound, sc.link
+	sc.mu.Unlock()
+
+	if queue == nil {
+		return sc.sendRawMessage(stdin, msg)
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case queue <- b:
+		return nil
+	default:
+	}
+
+	disconnect := !droppableMessages[msg.Type]
+	sc.mu.Lock()
+	sc.framesDropped++
+	if disconnect {
+		sc.overflowDisconnects++
+	}
+	sc.mu.Unlock()
+
+	if disconnect {
+		log.Printf("Outbound queue for %s is full; closing link to resync", sc.addr)
+		_ = link.Close()
+	}
+	return fmt.Errorf("%w: dropped %s", errOutboundQueueFull, msg.Type)
+}
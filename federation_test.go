@@ -2,10 +2,16 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	cryptossh "golang.org/x/crypto/ssh"
 )
 
 func TestEnsureKnownHostsFileAndNewFederationValidation(t *testing.T) {
@@ -20,17 +26,170 @@ func TestEnsureKnownHostsFileAndNewFederationValidation(t *testing.T) {
 		t.Fatalf("ensureKnownHostsFile(existing) error: %v", err)
 	}
 
+	_, peerPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+	peerSigner, err := cryptossh.NewSignerFromKey(peerPriv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey error: %v", err)
+	}
+	_, strangerPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+	strangerSigner, err := cryptossh.NewSignerFromKey(strangerPriv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey error: %v", err)
+	}
+
 	h := newHub()
-	if _, err := NewFederation(h, []string{"server:22"}, knownHosts, ""); err == nil {
+	if _, err := NewFederation(h, FederationConfig{Servers: []string{"server:22"}, KnownHostsPath: knownHosts}, nil); err == nil {
 		t.Fatal("NewFederation should fail with servers configured and empty shared secret")
 	}
 
-	f, err := NewFederation(h, []string{"server:22"}, knownHosts, "secret")
+	f, err := NewFederation(h, FederationConfig{
+		Servers:           []string{"server:22", "other:22"},
+		KnownHostsPath:    knownHosts,
+		SharedSecret:      "secret",
+		PeerSecrets:       []string{"other:22=other-secret"},
+		PeerKeys:          []string{"other:22=" + string(cryptossh.MarshalAuthorizedKey(peerSigner.PublicKey()))},
+		ReconnectMaxDelay: time.Minute,
+	}, nil)
 	if err != nil {
 		t.Fatalf("NewFederation(valid) error: %v", err)
 	}
-	if len(f.servers) != 1 {
-		t.Fatalf("len(f.servers) = %d, want 1", len(f.servers))
+	if len(f.servers) != 2 {
+		t.Fatalf("len(f.servers) = %d, want 2", len(f.servers))
+	}
+	if f.servers[0].sharedSecret != "secret" || f.servers[1].sharedSecret != "other-secret" {
+		t.Fatalf("unexpected peer secrets: %q, %q", f.servers[0].sharedSecret, f.servers[1].sharedSecret)
+	}
+	if f.servers[0].nonces != f.servers[1].nonces {
+		t.Fatal("server connections should share the federation nonce cache")
+	}
+	if f.servers[0].reconnectMaxDelay != time.Minute {
+		t.Fatalf("reconnectMaxDelay = %s, want 1m", f.servers[0].reconnectMaxDelay)
+	}
+	if got := f.serverForKey(peerSigner.PublicKey()); got != f.servers[1] {
+		t.Fatalf("serverForKey(peer key) = %v, want other:22", got)
+	}
+	if f.IsPeerKey(strangerSigner.PublicKey()) {
+		t.Fatal("IsPeerKey should reject keys that are not configured")
+	}
+}
+
+func TestBackoffDelayGrowsAndIsCapped(t *testing.T) {
+	for attempt := 0; attempt < 12; attempt++ {
+		want := federationInitialBackoff << attempt
+		if want > 30*time.Second {
+			want = 30 * time.Second
+		}
+		got := backoffDelay(attempt, 30*time.Second)
+		if got < want/2 || got > want {
+			t.Fatalf("backoffDelay(%d) = %s, want within [%s, %s]", attempt, got, want/2, want)
+		}
+	}
+}
+
+func TestServerConnectionStatus(t *testing.T) {
+	sc := NewServerConnection("server:22", newHub(), "", "secret")
+	if got := sc.Status().State; got != linkIdle {
+		t.Fatalf("initial state = %q, want %q", got, linkIdle)
+	}
+
+	retry := time.Now().Add(time.Minute)
+	sc.setLinkState(linkBackingOff, retry)
+	if st := sc.Status(); st.State != linkBackingOff || !st.NextRetry.Equal(retry) {
+		t.Fatalf("unexpected backoff status: %+v", st)
+	}
+
+	sc.setAuthenticated(true)
+	if st := sc.Status(); st.State != linkAuthenticated || !st.NextRetry.IsZero() {
+		t.Fatalf("unexpected authenticated status: %+v", st)
+	}
+}
+
+// closeRecorder is a link channel that remembers being closed.
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestSecondLinkToLinkedPeerIsTurnedAway(t *testing.T) {
+	// Nothing listens on port 1, so a dial would fail and back off.
+	sc := NewServerConnection("127.0.0.1:1", newHub(), filepath.Join(t.TempDir(), "known_hosts"), "secret")
+	if _, _, ok := sc.beginLink(&bytes.Buffer{}, linkOutbound); !ok {
+		t.Fatal("the first link should be attached")
+	}
+
+	second := &closeRecorder{}
+	if err := sc.serveLink(second, linkInbound); !errors.Is(err, errLinkActive) {
+		t.Fatalf("second link error = %v, want errLinkActive", err)
+	}
+	if !second.closed || second.Len() != 0 {
+		t.Fatal("the second link should be closed before anything is sent on it")
+	}
+
+	// While the peer's own link is up, it is not dialled at all.
+	sc.heartbeatInterval = 10 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		sc.maintainConnection()
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if got := sc.Status().State; got != linkIdle {
+		t.Fatalf("state with a link up = %q, want %q", got, linkIdle)
+	}
+	close(sc.stop)
+	<-done
+
+	sc.resetConnection()
+	if _, _, ok := sc.beginLink(&bytes.Buffer{}, linkInbound); !ok {
+		t.Fatal("a new link should be attached once the old one is gone")
+	}
+}
+
+func TestLinkDialledByLowerServerIDWins(t *testing.T) {
+	sc := NewServerConnection("127.0.0.1:1", newHub(), filepath.Join(t.TempDir(), "known_hosts"), "secret")
+	sc.peerKey = newTestSigner(t).PublicKey()
+	peerID := serverIDFromKey(sc.peerKey)
+
+	// Our ID sorts above the peer's, so the peer's outbound link, inbound
+	// here, is the one both ends keep.
+	sc.localID = peerID + "0"
+	first := &closeRecorder{}
+	if _, _, ok := sc.beginLink(first, linkOutbound); !ok {
+		t.Fatal("the first link should be attached")
+	}
+	sc.link = first
+	sc.authenticated = true
+
+	replaced, wasAuthenticated, ok := sc.beginLink(&closeRecorder{}, linkInbound)
+	if !ok || replaced != first || !wasAuthenticated {
+		t.Fatalf("preferred link: replaced = %v, wasAuthenticated = %v, ok = %v", replaced, wasAuthenticated, ok)
+	}
+	if sc.isLink(first) || sc.isAuthenticated() {
+		t.Fatal("the replaced link should no longer carry the session")
+	}
+	if _, _, ok := sc.beginLink(&closeRecorder{}, linkOutbound); ok {
+		t.Fatal("a link the peer does not keep should be turned away")
+	}
+
+	// Frames still arriving on the replaced link are not acted on.
+	first.WriteString("{}\n")
+	if _, err := (currentLinkReader{sc: sc, channel: first}).Read(make([]byte, 8)); !errors.Is(err, errLinkReplaced) {
+		t.Fatalf("read from replaced link error = %v, want errLinkReplaced", err)
+	}
+	sc.endLink(first)
+	if !sc.hasLink() {
+		t.Fatal("ending the replaced link should leave the new one up")
 	}
 }
 
@@ -48,8 +207,82 @@ func TestServerConnectionSendAuthAndRawMessage(t *testing.T) {
 	}
 
 	output := buf.String()
-	if !strings.Contains(output, `"type":"auth"`) {
-		t.Fatalf("expected auth message in output, got %q", output)
+	if !strings.Contains(output, `"type":"auth_challenge"`) {
+		t.Fatalf("expected auth challenge in output, got %q", output)
+	}
+	if strings.Contains(output, "secret") {
+		t.Fatalf("auth challenge must not contain the shared secret: %q", output)
+	}
+}
+
+func TestFrameRoundTripAndLimits(t *testing.T) {
+	buf := &bytes.Buffer{}
+	payloads := [][]byte{[]byte(`{"type":"x"}`), []byte("line one\nline two\x00\x1b[31m"), {}}
+	for _, p := range payloads {
+		if err := writeFrame(buf, p); err != nil {
+			t.Fatalf("writeFrame error: %v", err)
+		}
+	}
+	for _, want := range payloads {
+		got, err := readFrame(buf)
+		if err != nil {
+			t.Fatalf("readFrame error: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("readFrame() = %q, want %q", got, want)
+		}
+	}
+
+	if err := writeFrame(buf, make([]byte, federationMaxFrameSize+1)); err == nil {
+		t.Fatal("writeFrame should reject oversized payloads")
+	}
+
+	if _, err := readFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})); err == nil {
+		t.Fatal("readFrame should reject oversized length headers")
+	}
+
+	if _, err := readFrame(bytes.NewReader([]byte{0, 0, 0, 5, 'a'})); err == nil {
+		t.Fatal("readFrame should fail on a truncated frame")
+	}
+}
+
+func TestFederationChallengeResponseRejectsBadMACAndReplay(t *testing.T) {
+	sc := NewServerConnection("server:22", newHub(), "", "shared")
+	sc.setConnection(&bytes.Buffer{})
+	if err := sc.sendAuth(); err != nil {
+		t.Fatalf("sendAuth error: %v", err)
+	}
+
+	peerNonce, err := generateNonce()
+	if err != nil {
+		t.Fatalf("generateNonce error: %v", err)
+	}
+	if err := sc.answerChallenge(AuthChallengePayload{Nonce: peerNonce}); err != nil {
+		t.Fatalf("answerChallenge error: %v", err)
+	}
+
+	localNonce := sc.localNonce
+	bad := AuthResponsePayload{Nonce: peerNonce, MAC: federationAuthMAC("wrong", localNonce, peerNonce)}
+	if err := sc.verifyResponse(bad); err == nil {
+		t.Fatal("verifyResponse should reject a MAC computed with the wrong secret")
+	}
+
+	good := AuthResponsePayload{Nonce: peerNonce, MAC: federationAuthMAC("shared", localNonce, peerNonce)}
+	if err := sc.verifyResponse(good); err == nil {
+		t.Fatal("verifyResponse should not accept a response after the challenge was consumed")
+	}
+
+	other := NewServerConnection("server:22", newHub(), "", "shared")
+	other.nonces = sc.nonces
+	other.setConnection(&bytes.Buffer{})
+	if err := other.sendAuth(); err != nil {
+		t.Fatalf("sendAuth error: %v", err)
+	}
+	if err := other.answerChallenge(AuthChallengePayload{Nonce: peerNonce}); err == nil {
+		t.Fatal("answerChallenge should reject a replayed nonce")
+	}
+	if err := other.answerChallenge(AuthChallengePayload{Nonce: localNonce}); err == nil {
+		t.Fatal("answerChallenge should reject our own nonce reflected back")
 	}
 }
 
@@ -57,32 +290,47 @@ func TestHandleConnectionAuthAndDispatch(t *testing.T) {
 	h := &Hub{
 		syncNicks:        make(chan nickSyncRequest, 1),
 		privateMsgChan:   make(chan privateMessagePayload, 1),
+		remoteBroadcast:  make(chan remotePublicMessage, 1),
 		remoteNameChange: make(chan remoteNameChangeRequest, 1),
 	}
 
 	sc := NewServerConnection("server:22", h, "", "shared")
+	sc.setConnection(&bytes.Buffer{})
+	if err := sc.sendAuth(); err != nil {
+		t.Fatalf("sendAuth error: %v", err)
+	}
+	localNonce := sc.localNonce
+	peerNonce, err := generateNonce()
+	if err != nil {
+		t.Fatalf("generateNonce error: %v", err)
+	}
 
-	buildLine := func(msgType string, payload any) string {
+	input := &bytes.Buffer{}
+	writeMsg := func(msgType string, payload any) {
 		b, err := json.Marshal(payload)
 		if err != nil {
 			t.Fatalf("marshal payload: %v", err)
 		}
 		msg := FederationMessage{Type: msgType, Payload: b}
-		line, err := json.Marshal(msg)
+		frame, err := json.Marshal(msg)
 		if err != nil {
 			t.Fatalf("marshal message: %v", err)
 		}
-		return string(line)
+		if err := writeFrame(input, frame); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
 	}
 
-	input := strings.Join([]string{
-		buildLine("auth", AuthPayload{Secret: "shared"}),
-		buildLine("nick_sync", NickSyncPayload{Nicks: []string{"Alice", "Bob"}}),
-		buildLine("private_message", PrivateMessagePayload{From: "Alice", To: "Bob", Text: "hi"}),
-		buildLine("name_change", NameChangePayload{OldName: "Alice", NewName: "Alice2", IsGitHubAuth: true}),
-	}, "\n") + "\n"
+	writeMsg("auth_challenge", AuthChallengePayload{Nonce: peerNonce})
+	writeMsg("auth_response", AuthResponsePayload{Nonce: peerNonce, MAC: federationAuthMAC("shared", localNonce, peerNonce)})
+	writeMsg("nick_sync", NickSyncPayload{Nicks: []string{"Alice", "Bob"}, Claims: map[string]NickClaim{"Alice": {Clock: 2, Authed: true, Provider: "github"}}})
+	writeMsg("private_message", PrivateMessagePayload{From: "Alice", To: "Bob", Text: "hi", FromAuthed: true, FromProvider: "github"})
+	writeMsg("public_message", PublicMessagePayload{From: "Alice", Text: "hello all", Room: "#ops", AuthorIsAuthed: true})
+	writeMsg("name_change", NameChangePayload{OldName: "Alice", NewName: "Alice2", IsGitHubAuth: true})
 
-	sc.handleConnection(strings.NewReader(input))
+	if err := sc.handleConnection(input); err != nil {
+		t.Fatalf("handleConnection returned error on clean EOF: %v", err)
+	}
 
 	if !sc.isAuthenticated() {
 		t.Fatal("server connection should be authenticated after valid auth message")
@@ -93,19 +341,32 @@ func TestHandleConnectionAuthAndDispatch(t *testing.T) {
 		if req.serverAddr != "server:22" || len(req.nicks) != 2 {
 			t.Fatalf("unexpected sync request: %+v", req)
 		}
+		if alice := req.routes["Alice"]; !alice.Authed || alice.Provider != "github" || req.routes["Bob"].Authed {
+			t.Fatalf("nick sync should carry per-user auth status, got %+v", req.routes)
+		}
 	default:
 		t.Fatal("expected nick sync request")
 	}
 
 	select {
 	case p := <-h.privateMsgChan:
-		if p.TargetUser != "Bob" || p.Message.Content != "hi" {
+		if p.TargetUser != "Bob" || p.Message.Content != "hi" || !p.Message.AuthorIsAuthed || p.Message.AuthProvider != "github" {
 			t.Fatalf("unexpected private message payload: %+v", p)
 		}
 	default:
 		t.Fatal("expected private message payload")
 	}
 
+	select {
+	case req := <-h.remoteBroadcast:
+		m := req.message
+		if m.Author != "Alice" || m.Content != "hello all" || m.Room != "#ops" || !m.AuthorIsAuthed || m.Type != "public" {
+			t.Fatalf("unexpected public message: %+v", m)
+		}
+	default:
+		t.Fatal("expected public message")
+	}
+
 	select {
 	case req := <-h.remoteNameChange:
 		if req.newName != "Alice2" || !req.isGitHubAuth {
@@ -115,3 +376,179 @@ func TestHandleConnectionAuthAndDispatch(t *testing.T) {
 		t.Fatal("expected remote name change request")
 	}
 }
+
+func TestHelloNegotiatesCapabilities(t *testing.T) {
+	sc := NewServerConnection("server:22", newHub(), "", "secret")
+	if !sc.supports("nick_sync") || sc.supports("public_message") {
+		t.Fatal("before hello a peer should be assumed to support only the legacy message types")
+	}
+
+	buf := &bytes.Buffer{}
+	sc.setConnection(buf)
+	sc.localID = "abc"
+	if err := sc.sendHello(); err != nil {
+		t.Fatalf("sendHello error: %v", err)
+	}
+	frame, err := readFrame(buf)
+	if err != nil {
+		t.Fatalf("readFrame error: %v", err)
+	}
+	var msg FederationMessage
+	if err := json.Unmarshal(frame, &msg); err != nil || msg.Type != "hello" {
+		t.Fatalf("unexpected hello frame %q: %v", frame, err)
+	}
+	var hello HelloPayload
+	if err := json.Unmarshal(msg.Payload, &hello); err != nil {
+		t.Fatalf("unmarshal hello: %v", err)
+	}
+	if hello.ProtocolVersion != federationProtocolVersion || hello.ServerID != "abc" || len(hello.Capabilities) == 0 {
+		t.Fatalf("unexpected hello payload: %+v", hello)
+	}
+
+	if err := sc.handleHello(HelloPayload{ProtocolVersion: 0}); err == nil {
+		t.Fatal("handleHello should reject protocol versions below the minimum")
+	}
+
+	if err := sc.handleHello(HelloPayload{ProtocolVersion: 1, SoftwareVersion: "1.2.3", Capabilities: []string{"public_message"}}); err != nil {
+		t.Fatalf("handleHello error: %v", err)
+	}
+	if !sc.supports("public_message") || sc.supports("nick_sync") {
+		t.Fatal("after hello only advertised capabilities should be used")
+	}
+	if st := sc.Status(); st.Peer == nil || st.Peer.SoftwareVersion != "1.2.3" {
+		t.Fatalf("status should expose the peer version, got %+v", st)
+	}
+}
+
+func TestNickDeltasSequenceAndChecksum(t *testing.T) {
+	if nickChecksum([]string{"bob", "alice"}) != nickChecksum([]string{"alice", "bob"}) {
+		t.Fatal("nickChecksum should not depend on list order")
+	}
+	if nickChecksum([]string{"alice"}) == nickChecksum([]string{"alice", "bob"}) {
+		t.Fatal("nickChecksum should change when the list changes")
+	}
+
+	h := &Hub{
+		remoteUserDelta: make(chan remoteUserDeltaRequest, 2),
+		remoteNicks:     make(map[string]map[string]nickRoute),
+	}
+	sc := NewServerConnection("server:22", h, "", "secret")
+	out := &bytes.Buffer{}
+	sc.setConnection(out)
+	sc.setAuthenticated(true)
+
+	input := &bytes.Buffer{}
+	for _, m := range []struct {
+		typ  string
+		nick string
+		seq  uint64
+	}{{"user_join", "carol", 1}, {"user_leave", "carol", 3}} {
+		b, _ := json.Marshal(UserDeltaPayload{Nick: m.nick, Seq: m.seq})
+		frame, _ := json.Marshal(FederationMessage{Type: m.typ, Payload: b})
+		if err := writeFrame(input, frame); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+	}
+	if err := sc.handleConnection(input); err != nil {
+		t.Fatalf("handleConnection error: %v", err)
+	}
+
+	h.applyUserDelta(<-h.remoteUserDelta)
+	if !h.isNameTakenInFederation("carol") {
+		t.Fatal("user_join should add the remote nick")
+	}
+	h.applyUserDelta(<-h.remoteUserDelta)
+	if h.isNameTakenInFederation("carol") {
+		t.Fatal("user_leave should remove the remote nick")
+	}
+
+	if sc.currentInSeq() != 3 {
+		t.Fatalf("inSeq = %d, want 3", sc.currentInSeq())
+	}
+	if !strings.Contains(out.String(), "nick_sync_request") {
+		t.Fatal("a sequence gap should trigger a nick_sync_request")
+	}
+}
+
+type closeSignal chan struct{}
+
+func (c closeSignal) Close() error {
+	close(c)
+	return nil
+}
+
+func TestHeartbeatRecordsRTTAndClosesDeadLinks(t *testing.T) {
+	sc := NewServerConnection("server:22", newHub(), "", "secret")
+	out := &bytes.Buffer{}
+	sc.setConnection(out)
+	sc.setAuthenticated(true)
+
+	input := &bytes.Buffer{}
+	b, _ := json.Marshal(PingPayload{SentAt: time.Now().Add(-50 * time.Millisecond).UnixNano()})
+	for _, typ := range []string{"ping", "pong"} {
+		frame, _ := json.Marshal(FederationMessage{Type: typ, Payload: b})
+		if err := writeFrame(input, frame); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+	}
+	if err := sc.handleConnection(input); err != nil {
+		t.Fatalf("handleConnection error: %v", err)
+	}
+	if !strings.Contains(out.String(), `"type":"pong"`) {
+		t.Fatal("a ping should be answered with a pong")
+	}
+	if st := sc.Status(); st.RTT < 50*time.Millisecond || st.LastSeen.IsZero() {
+		t.Fatalf("status should expose rtt and last seen, got %+v", st)
+	}
+
+	if err := sc.handleHello(HelloPayload{ProtocolVersion: 1, Capabilities: []string{"heartbeat"}}); err != nil {
+		t.Fatalf("handleHello error: %v", err)
+	}
+	sc.heartbeatInterval = 5 * time.Millisecond
+	sc.heartbeatMisses = 2
+
+	closed := make(closeSignal)
+	done := make(chan struct{})
+	defer close(done)
+	go sc.runHeartbeat(closed, done)
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the link should be closed after too many missed heartbeats")
+	}
+}
+
+func TestOutboundQueueOverflow(t *testing.T) {
+	sc := NewServerConnection("server:22", newHub(), "", "secret")
+	sc.setConnection(&bytes.Buffer{})
+	sc.setAuthenticated(true)
+	sc.handleHello(HelloPayload{ProtocolVersion: 1, Capabilities: []string{"public_message", "private_message"}})
+
+	// A writer that never drains stands in for a stuck peer.
+	link := make(closeSignal)
+	sc.mu.Lock()
+	sc.outbound = make(chan []byte, 1)
+	sc.link = link
+	sc.mu.Unlock()
+
+	sc.sendPublicMessage(Message{Author: "alice", Content: "one"}, 1)
+	sc.sendPublicMessage(Message{Author: "alice", Content: "two"}, 1)
+	select {
+	case <-link:
+		t.Fatal("dropping a public message should not close the link")
+	default:
+	}
+
+	sc.sendPrivateMessage(PrivateMessagePayload{From: "alice", To: "bob", Text: "hi", Hops: 1})
+	select {
+	case <-link:
+	default:
+		t.Fatal("overflowing with a private message should close the link")
+	}
+
+	st := sc.Status()
+	if st.Queued != 1 || st.Dropped != 2 || st.Disconnects != 1 {
+		t.Fatalf("unexpected queue counters: %+v", st)
+	}
+}
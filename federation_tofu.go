@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// In trust-on-first-use mode a peer whose host key is not in known_hosts is
+// not connected to. Its key is held as pending, with its fingerprint, until
+// an admin approves it; it is then appended to known_hosts and the link is
+// retried. A key that differs from a known one is never put up for approval,
+// and neither is a second key for a peer that already has one pending: the
+// admin must reject the first before another can take its place.
+
+type pendingHostKey struct {
+	Addr        string
+	Key         cryptossh.PublicKey
+	Fingerprint string
+	SeenAt      time.Time
+}
+
+type pendingHostKeys struct {
+	mu   sync.Mutex
+	keys map[string]pendingHostKey // By peer address
+}
+
+func newPendingHostKeys() *pendingHostKeys {
+	return &pendingHostKeys{keys: make(map[string]pendingHostKey)}
+}
+
+// add holds key for addr and reports whether it was not pending already.
+// A different key for an address that has one pending is refused, so the key
+// an admin is checking cannot be swapped before they approve it.
+func (p *pendingHostKeys) add(addr string, key cryptossh.PublicKey) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fingerprint := cryptossh.FingerprintSHA256(key)
+	if previous, ok := p.keys[addr]; ok {
+		if previous.Fingerprint != fingerprint {
+			return false, fmt.Errorf("host key %s is already pending", previous.Fingerprint)
+		}
+		previous.SeenAt = time.Now()
+		p.keys[addr] = previous
+		return false, nil
+	}
+	p.keys[addr] = pendingHostKey{Addr: addr, Key: key, Fingerprint: fingerprint, SeenAt: time.Now()}
+	return true, nil
+}
+
+// take removes and returns the pending key for addr. The fingerprint must
+// match it, so an admin never approves a key they have not checked.
+func (p *pendingHostKeys) take(addr, fingerprint string) (pendingHostKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.keys[addr]
+	if !ok {
+		return pendingHostKey{}, errors.New("no pending host key")
+	}
+	if fingerprint == "" {
+		return pendingHostKey{}, errors.New("the key's fingerprint is required")
+	}
+	if fingerprint != pending.Fingerprint {
+		return pendingHostKey{}, fmt.Errorf("pending key has fingerprint %s", pending.Fingerprint)
+	}
+	delete(p.keys, addr)
+	return pending, nil
+}
+
+// remove drops the pending key for addr, whatever it is, and returns it.
+func (p *pendingHostKeys) remove(addr string) (pendingHostKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.keys[addr]
+	if !ok {
+		return pendingHostKey{}, errors.New("no pending host key")
+	}
+	delete(p.keys, addr)
+	return pending, nil
+}
+
+func (p *pendingHostKeys) list() []pendingHostKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]pendingHostKey, 0, len(p.keys))
+	for _, pending := range p.keys {
+		list = append(list, pending)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list
+}
+
+// checkHostKey wraps the known_hosts callback. Keys for hosts that are not
+// in the file at all are reported with their fingerprint and, in TOFU mode,
+// held for approval.
+func (sc *ServerConnection) checkHostKey(known cryptossh.HostKeyCallback) cryptossh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key cryptossh.PublicKey) error {
+		err := known(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if err == nil || !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+
+		fingerprint := cryptossh.FingerprintSHA256(key)
+		if sc.pendingKeys == nil {
+			return fmt.Errorf("host key %s is not in %s", fingerprint, sc.knownHostsPath)
+		}
+		added, err := sc.pendingKeys.add(sc.addr, key)
+		if err != nil {
+			log.Printf("Federation peer %s presented host key %s while another is awaiting approval: %v", sc.addr, fingerprint, err)
+			sc.hub.auditLog().record(auditEntry{Event: auditFederationReject, Peer: sc.addr, Fingerprint: fingerprint, Error: err.Error()})
+			return fmt.Errorf("host key %s refused: %w", fingerprint, err)
+		}
+		if added {
+			log.Printf("Federation peer %s presented unknown host key %s; approve it with `fed approve %s %s`", sc.addr, fingerprint, sc.addr, fingerprint)
+			sc.hub.auditLog().record(auditEntry{Event: auditFederationReject, Peer: sc.addr, Fingerprint: fingerprint, Error: "unknown host key awaiting approval"})
+		}
+		return fmt.Errorf("host key %s is awaiting approval", fingerprint)
+	}
+}
+
+func (sc *ServerConnection) getPeerKey() cryptossh.PublicKey {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.peerKey
+}
+
+// PendingHostKeys lists unknown host keys awaiting approval.
+func (f *Federation) PendingHostKeys() []pendingHostKey {
+	if f.pendingKeys == nil {
+		return nil
+	}
+	return f.pendingKeys.list()
+}
+
+// ApproveHostKey trusts the pending host key of addr, which must have the
+// given fingerprint: it is appended to
+// known_hosts, recognises the peer's inbound links if no peer_keys entry was
+// configured, and the peer is dialled again right away.
+func (f *Federation) ApproveHostKey(addr, fingerprint string) error {
+	if f.pendingKeys == nil {
+		return errors.New("trust_on_first_use is not enabled")
+	}
+	pending, err := f.pendingKeys.take(addr, fingerprint)
+	if err != nil {
+		return err
+	}
+	if err := addKnownHost(f.config.KnownHostsPath, addr, pending.Key); err != nil {
+		_, _ = f.pendingKeys.add(addr, pending.Key)
+		return fmt.Errorf("update known_hosts: %w", err)
+	}
+	log.Printf("Approved host key %s for federation peer %s", pending.Fingerprint, addr)
+
+	if sc := f.serverByAddr(addr); sc != nil {
+		sc.mu.Lock()
+		if sc.peerKey == nil {
+			sc.peerKey = pending.Key
+		}
+		sc.mu.Unlock()
+		sc.wakeUp()
+	}
+	return nil
+}
+
+// RejectHostKey forgets the pending host key of addr. The peer is put up for
+// approval again the next time it is dialled.
+func (f *Federation) RejectHostKey(addr string) error {
+	if f.pendingKeys == nil {
+		return errors.New("trust_on_first_use is not enabled")
+	}
+	pending, err := f.pendingKeys.remove(addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rejected host key %s for federation peer %s", pending.Fingerprint, addr)
+	return nil
+}
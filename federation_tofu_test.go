@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestTrustOnFirstUseApproval(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	addr := "127.0.0.1:2222"
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222}
+
+	h := newHub()
+	f, err := NewFederation(h, FederationConfig{
+		Servers:         []string{addr},
+		KnownHostsPath:  knownHosts,
+		SharedSecret:    "secret",
+		TrustOnFirstUse: true,
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewFederation error: %v", err)
+	}
+	h.federation = f
+	sc := f.serverByAddr(addr)
+
+	key := newTestSigner(t).PublicKey()
+	fingerprint := cryptossh.FingerprintSHA256(key)
+
+	check := func() error {
+		known, err := knownhosts.New(knownHosts)
+		if err != nil {
+			t.Fatalf("knownhosts.New error: %v", err)
+		}
+		return sc.checkHostKey(known)(addr, remote, key)
+	}
+
+	if err := check(); err == nil || !strings.Contains(err.Error(), "awaiting approval") {
+		t.Fatalf("unknown key error = %v, want it held for approval", err)
+	}
+	if pending := f.PendingHostKeys(); len(pending) != 1 || pending[0].Fingerprint != fingerprint {
+		t.Fatalf("PendingHostKeys() = %+v, want %s", pending, fingerprint)
+	}
+
+	// A second key cannot take the place of the one the admin is checking.
+	swapped := newTestSigner(t).PublicKey()
+	known, err := knownhosts.New(knownHosts)
+	if err != nil {
+		t.Fatalf("knownhosts.New error: %v", err)
+	}
+	if err := sc.checkHostKey(known)(addr, remote, swapped); err == nil || !strings.Contains(err.Error(), "already pending") {
+		t.Fatalf("second unknown key error = %v, want it refused", err)
+	}
+	if pending := f.PendingHostKeys(); len(pending) != 1 || pending[0].Fingerprint != fingerprint {
+		t.Fatalf("PendingHostKeys() = %+v, want %s kept", pending, fingerprint)
+	}
+
+	// Rejecting the pending key makes room for the next one the peer shows.
+	if got := runFederationCommand(f, nil, "admin", "/fed", []string{"reject", addr}); got != addr+" host key rejected." {
+		t.Fatalf("fed reject = %q", got)
+	}
+	if pending := f.PendingHostKeys(); len(pending) != 0 {
+		t.Fatalf("PendingHostKeys() = %+v after reject, want none", pending)
+	}
+	if got := runFederationCommand(f, nil, "admin", "/fed", []string{"reject", addr}); !strings.Contains(got, "no pending host key") {
+		t.Fatalf("fed reject with nothing pending = %q", got)
+	}
+	if err := check(); err == nil || !strings.Contains(err.Error(), "awaiting approval") {
+		t.Fatalf("key after reject error = %v, want it held for approval again", err)
+	}
+
+	if err := f.ApproveHostKey(addr, "SHA256:wrong"); err == nil {
+		t.Fatal("approving with the wrong fingerprint should fail")
+	}
+	if err := f.ApproveHostKey(addr, ""); err == nil {
+		t.Fatal("approving without a fingerprint should fail")
+	}
+	if got := runFederationCommand(f, nil, "admin", "/fed", []string{"approve", addr}); !strings.HasPrefix(got, "Usage") {
+		t.Fatalf("fed approve without a fingerprint = %q, want usage", got)
+	}
+	if got := runFederationCommand(f, nil, "admin", "/fed", []string{"approve", addr, fingerprint}); got != "Host key for "+addr+" approved." {
+		t.Fatalf("fed approve = %q", got)
+	}
+	if err := check(); err != nil {
+		t.Fatalf("approved key rejected: %v", err)
+	}
+	if !f.IsPeerKey(key) {
+		t.Fatal("an approved key should also recognise the peer's inbound links")
+	}
+
+	// A changed key is a mismatch, never a new candidate for approval.
+	known, err = knownhosts.New(knownHosts)
+	if err != nil {
+		t.Fatalf("knownhosts.New error: %v", err)
+	}
+	if err := sc.checkHostKey(known)(addr, remote, newTestSigner(t).PublicKey()); err == nil {
+		t.Fatal("a changed host key must be rejected")
+	}
+	if pending := f.PendingHostKeys(); len(pending) != 0 {
+		t.Fatalf("a changed host key was put up for approval: %+v", pending)
+	}
+
+	// Without TOFU the error names the fingerprint to add by hand.
+	plain := NewServerConnection(addr, h, knownHosts, "secret")
+	if err := plain.checkHostKey(known)("other:22", remote, key); err == nil || !strings.Contains(err.Error(), fingerprint) {
+		t.Fatalf("unknown key without TOFU = %v, want the fingerprint", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// The harness runs several complete SoftRoom nodes in one process: each has
+// its own Hub, Federation and SSH server on a loopback port, a generated
+// host key, and a known_hosts file with the keys of its peers. Chat users are
+// attached straight to a hub, so scenarios can be scripted with the same
+// commands a user types and asserted on what each user receives.
+
+const harnessTimeout = 15 * time.Second
+
+type testNetwork struct {
+	t     *testing.T
+	nodes map[string]*testNode
+}
+
+type testNode struct {
+	name     string
+	cfg      *Config
+	signer   cryptossh.Signer
+	addr     string
+	listener net.Listener
+	hub      *Hub
+	fed      *Federation
+	server   *ssh.Server
+}
+
+type testUser struct {
+	t      *testing.T
+	node   *testNode
+	client *Client
+}
+
+// newTestNetwork starts a node per name and links each pair in links, e.g.
+// [2]string{"alpha", "beta"}. Both ends list each other, as in production.
+func newTestNetwork(t *testing.T, names []string, links ...[2]string) *testNetwork {
+	t.Helper()
+	return newTestNetworkWith(t, nil, names, links...)
+}
+
+// newTestNetworkWith is newTestNetwork with a setup hook that can adjust each
+// node's config before any node starts.
+func newTestNetworkWith(t *testing.T, setup func(*testNetwork), names []string, links ...[2]string) *testNetwork {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("multi-node federation test")
+	}
+
+	n := &testNetwork{t: t, nodes: make(map[string]*testNode)}
+	dir := t.TempDir()
+	for _, name := range names {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey error: %v", err)
+		}
+		signer, err := cryptossh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatalf("NewSignerFromKey error: %v", err)
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen error: %v", err)
+		}
+
+		cfg := new(Config)
+		cfg.Federation = FederationConfig{
+			ServerName:        name,
+			KnownHostsPath:    filepath.Join(dir, name+"_known_hosts"),
+			SharedSecret:      "harness-secret",
+			ReconnectMaxDelay: 2 * time.Second,
+			HeartbeatInterval: 250 * time.Millisecond,
+			HeartbeatMisses:   4,
+			OutboundQueueSize: defaultOutboundQueueSize,
+		}
+		cfg.Chat.ShowServerNames = true
+		n.nodes[name] = &testNode{name: name, cfg: cfg, signer: signer, addr: listener.Addr().String(), listener: listener}
+	}
+
+	for _, link := range links {
+		a, b := n.node(link[0]), n.node(link[1])
+		a.addPeerConfig(t, b)
+		b.addPeerConfig(t, a)
+	}
+
+	if setup != nil {
+		setup(n)
+	}
+	for _, name := range names {
+		n.nodes[name].start(t)
+	}
+	return n
+}
+
+func (n *testNetwork) node(name string) *testNode {
+	node, ok := n.nodes[name]
+	if !ok {
+		n.t.Fatalf("no node %q in the test network", name)
+	}
+	return node
+}
+
+// addPeerConfig makes peer a configured federation server of node.
+func (node *testNode) addPeerConfig(t *testing.T, peer *testNode) {
+	t.Helper()
+	fc := &node.cfg.Federation
+	fc.Servers = append(fc.Servers, peer.addr)
+	keyLine := strings.TrimSpace(string(cryptossh.MarshalAuthorizedKey(peer.signer.PublicKey())))
+	fc.PeerKeys = append(fc.PeerKeys, peer.addr+"="+keyLine)
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(peer.addr)}, peer.signer.PublicKey())
+	existing, _ := readFileWithRoot(fc.KnownHostsPath)
+	if err := writeFileWithRoot(fc.KnownHostsPath, append(existing, line+"\n"...), 0600); err != nil {
+		t.Fatalf("write known_hosts for %s: %v", node.name, err)
+	}
+}
+
+func (node *testNode) start(t *testing.T) {
+	t.Helper()
+	if err := ensureKnownHostsFile(node.cfg.Federation.KnownHostsPath); err != nil {
+		t.Fatalf("ensureKnownHostsFile error: %v", err)
+	}
+
+	node.hub = newHub()
+	node.hub.showServerNames = node.cfg.Chat.ShowServerNames
+	fed, err := NewFederation(node.hub, node.cfg.Federation, node.signer)
+	if err != nil {
+		t.Fatalf("NewFederation(%s) error: %v", node.name, err)
+	}
+	node.fed = fed
+	node.hub.federation = fed
+	go node.hub.run()
+
+	node.server = newSSHServer(node.cfg, node.hub, fed, node.signer)
+	go func() { _ = node.server.Serve(node.listener) }()
+	fed.Start()
+
+	t.Cleanup(func() {
+		for _, sc := range fed.Peers() {
+			_ = fed.RemovePeer(sc.addr)
+		}
+		_ = node.server.Close()
+	})
+}
+
+// peer returns the connection node keeps to the other node.
+func (node *testNode) peer(other *testNode) *ServerConnection {
+	return node.fed.serverByAddr(other.addr)
+}
+
+// users returns /u as node's users see it.
+func (node *testNode) users() []string {
+	return node.hub.getUserList()
+}
+
+// joinOption adjusts a test user's client before the hub sees it.
+type joinOption func(*Client)
+
+// withFingerprint gives a test user the SSH key fingerprint they would have
+// logged in with.
+func withFingerprint(fingerprint string) joinOption {
+	return func(c *Client) { c.fingerprint = fingerprint }
+}
+
+// join attaches a chat user called nick to node.
+func (node *testNode) join(t *testing.T, nick string, opts ...joinOption) *testUser {
+	t.Helper()
+	client := NewClient(nil, node.hub, nick, strings.NewReader(""), io.Discard)
+	for _, opt := range opts {
+		opt(client)
+	}
+	node.hub.register <- client
+	return &testUser{t: t, node: node, client: client}
+}
+
+// say runs input as if the user typed it.
+func (u *testUser) say(input string) {
+	u.t.Helper()
+	if reply, handled := handleCommand(u.client, input, u.node.cfg); handled {
+		if reply.Content != "" {
+			u.client.EnqueueMessage(reply)
+		}
+		return
+	}
+	u.client.hub.broadcast <- Message{
+		Author:         u.client.User(),
+		Content:        input,
+		Type:           "public",
+		AuthorIsAuthed: u.client.IsAuthed(),
+		AuthProvider:   u.client.AuthProvider(),
+		Room:           u.client.Room(),
+	}
+}
+
+// expect waits for a message to the user that contains text, discarding
+// anything received before it.
+func (u *testUser) expect(text string) Message {
+	u.t.Helper()
+	deadline := time.After(harnessTimeout)
+	for {
+		select {
+		case msg := <-u.client.send:
+			if strings.Contains(msg.Content, text) {
+				return msg
+			}
+		case <-deadline:
+			u.t.Fatalf("%s on %s never received a message containing %q", u.client.User(), u.node.name, text)
+			return Message{}
+		}
+	}
+}
+
+// eventually polls cond until it holds or the harness timeout expires.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(harnessTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// waitLinked waits until a and b have an authenticated link.
+func (n *testNetwork) waitLinked(a, b string) {
+	n.t.Helper()
+	na, nb := n.node(a), n.node(b)
+	eventually(n.t, fmt.Sprintf("%s and %s are linked", a, b), func() bool {
+		return na.peer(nb).isAuthenticated() && nb.peer(na).isAuthenticated()
+	})
+}
+
+// split cuts the link between a and b and keeps it down, as a netsplit.
+func (n *testNetwork) split(a, b string) {
+	n.t.Helper()
+	na, nb := n.node(a), n.node(b)
+	for _, err := range []error{na.fed.SetPeerDisabled(nb.addr, true), nb.fed.SetPeerDisabled(na.addr, true)} {
+		if err != nil {
+			n.t.Fatalf("split %s/%s: %v", a, b, err)
+		}
+	}
+}
+
+// heal lets a and b link up again after split.
+func (n *testNetwork) heal(a, b string) {
+	n.t.Helper()
+	na, nb := n.node(a), n.node(b)
+	for _, err := range []error{na.fed.SetPeerDisabled(nb.addr, false), nb.fed.SetPeerDisabled(na.addr, false)} {
+		if err != nil {
+			n.t.Fatalf("heal %s/%s: %v", a, b, err)
+		}
+	}
+}
+
+// seesUser reports whether label is in node's /u list.
+func (node *testNode) seesUser(label string) bool {
+	return slices.Contains(node.users(), label)
+}
@@ -3,20 +3,47 @@ package main
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 )
 
+const defaultRoom = "#lobby"
+
 type Message struct {
 	Author         string
 	Content        string
 	Type           string // "public", "private", "system"
 	AuthorIsAuthed bool   // True if the author is authenticated
+	AuthProvider   string // Provider that verified the author, e.g. "github"
+	Room           string // Target room; empty means every local client
+	Server         string // Home server of a remote author
+	ID             string // Federation-wide ID of a public message, used to drop duplicates
+}
+
+type remotePublicMessage struct {
+	message    Message
+	hops       int
+	serverAddr string
+}
+
+type roomChangeRequest struct {
+	client *Client
+	room   string
+}
+
+type roomSummary struct {
+	Name    string
+	Members int
 }
 
 type privateMessagePayload struct {
-	TargetUser string
-	Message    Message
-	Sender     *Client
+	TargetUser   string
+	TargetServer string // Set when the sender addressed nick@server
+	Message      Message
+	Sender       *Client
+	Hops         int    // Federation links already traversed
+	ID           string // Federation-wide ID, used to match delivery receipts
 }
 
 type nameChangeRequest struct {
@@ -29,45 +56,115 @@ type remoteNameChangeRequest struct {
 	oldName      string
 	newName      string
 	isGitHubAuth bool
+	provider     string
+	clock        uint64
 	serverAddr   string
+	id           string
+	hops         int
 }
 
 type nickSyncRequest struct {
 	serverAddr string
 	nicks      []string
+	routes     map[string]nickRoute // Keyed by nick as sent
+}
+
+type remoteUserDeltaRequest struct {
+	serverAddr string
+	nick       string
+	joined     bool
+	route      nickRoute
+}
+
+type nickChecksumRequest struct {
+	conn     *ServerConnection
+	checksum string
+}
+
+type nickSnapshotRequest struct {
+	conn *ServerConnection
+	full bool
 }
 
 type Hub struct {
-	mu                sync.RWMutex
-	clients           map[*Client]bool
-	clientsByName     map[string]*Client
-	remoteNicks       map[string][]string
-	broadcast         chan Message
-	register          chan *Client
-	unregister        chan *Client
-	requestUsers      chan chan []string
-	requestLocalUsers chan chan []string
-	privateMsgChan    chan privateMessagePayload
-	changeName        chan nameChangeRequest
-	remoteNameChange  chan remoteNameChangeRequest
-	syncNicks         chan nickSyncRequest
-	federation        *Federation
+	mu                 sync.RWMutex
+	clients            map[*Client]bool
+	clientsByName      map[string]*Client
+	rooms              map[string]map[*Client]bool
+	remoteNicks        map[string]map[string]nickRoute // Direct peer -> nick -> route
+	advertised         map[string]map[string]nickRoute // Direct peer -> nick -> route we advertised
+	seenMessages       *nonceCache
+	broadcast          chan Message
+	remoteBroadcast    chan remotePublicMessage
+	register           chan *Client
+	unregister         chan *Client
+	requestUsers       chan chan []string
+	requestLocalUsers  chan chan []string
+	privateMsgChan     chan privateMessagePayload
+	privateReceipts    chan PrivateMessageReceiptPayload
+	privateTimeouts    chan string
+	pendingPrivate     map[string]pendingPrivateMessage // Message ID -> DM awaiting a receipt
+	changeName         chan nameChangeRequest
+	remoteNameChange   chan remoteNameChangeRequest
+	syncNicks          chan nickSyncRequest
+	linkLost           chan string
+	remoteUserDelta    chan remoteUserDeltaRequest
+	verifyNicks        chan nickChecksumRequest
+	nickSnapshots      chan nickSnapshotRequest
+	splitPeers         map[string]bool
+	moderation         chan moderationAction
+	moderationRequests chan moderationRequest
+	roles              map[string]string // Lowercased GitHub login -> role
+	remoteModeration   chan remoteModerationRequest
+	sanctions          []moderationAction // Active mutes
+	bans               *BanList
+	floodMutes         chan floodMuteRequest
+	audit              *AuditLog // nil for no audit log
+	anonymousPolicy    string
+	waiting            map[*Client]bool // Anonymous clients held back by the blocked policy
+	clock              uint64           // Lamport clock for nick claims
+	showServerNames    bool             // Qualify remote nicks as nick@server for users
+	changeRoom         chan roomChangeRequest
+	requestRooms       chan chan []roomSummary
+	federation         *Federation
 }
 
 func newHub() *Hub {
 	return &Hub{
-		broadcast:         make(chan Message),
-		register:          make(chan *Client),
-		unregister:        make(chan *Client),
-		clients:           make(map[*Client]bool),
-		clientsByName:     make(map[string]*Client),
-		remoteNicks:       make(map[string][]string),
-		requestUsers:      make(chan chan []string),
-		requestLocalUsers: make(chan chan []string),
-		privateMsgChan:    make(chan privateMessagePayload),
-		changeName:        make(chan nameChangeRequest),
-		remoteNameChange:  make(chan remoteNameChangeRequest),
-		syncNicks:         make(chan nickSyncRequest),
+		broadcast:          make(chan Message),
+		remoteBroadcast:    make(chan remotePublicMessage),
+		register:           make(chan *Client),
+		unregister:         make(chan *Client),
+		clients:            make(map[*Client]bool),
+		clientsByName:      make(map[string]*Client),
+		rooms:              make(map[string]map[*Client]bool),
+		remoteNicks:        make(map[string]map[string]nickRoute),
+		advertised:         make(map[string]map[string]nickRoute),
+		seenMessages:       newNonceCache(seenMessageTTL),
+		requestUsers:       make(chan chan []string),
+		requestLocalUsers:  make(chan chan []string),
+		privateMsgChan:     make(chan privateMessagePayload),
+		privateReceipts:    make(chan PrivateMessageReceiptPayload),
+		privateTimeouts:    make(chan string),
+		pendingPrivate:     make(map[string]pendingPrivateMessage),
+		changeName:         make(chan nameChangeRequest),
+		remoteNameChange:   make(chan remoteNameChangeRequest),
+		syncNicks:          make(chan nickSyncRequest),
+		linkLost:           make(chan string),
+		moderation:         make(chan moderationAction),
+		moderationRequests: make(chan moderationRequest),
+		roles:              make(map[string]string),
+		bans:               &BanList{},
+		floodMutes:         make(chan floodMuteRequest),
+		anonymousPolicy:    anonymousAllowed,
+		waiting:            make(map[*Client]bool),
+		remoteModeration:   make(chan remoteModerationRequest),
+		remoteUserDelta:    make(chan remoteUserDeltaRequest),
+		verifyNicks:        make(chan nickChecksumRequest),
+		nickSnapshots:      make(chan nickSnapshotRequest, 16),
+		splitPeers:         make(map[string]bool),
+		changeRoom:         make(chan roomChangeRequest),
+		requestRooms:       make(chan chan []roomSummary),
 	}
 }
 
@@ -83,25 +180,129 @@ func (h *Hub) getLocalUserList() []string {
 	return <-respChan
 }
 
-func (h *Hub) sendPrivateMessage(targetUser string, msg Message, sender *Client) {
+func (h *Hub) localUserNames() []string {
+	users := make([]string, 0, len(h.clients))
+	for client := range h.clients {
+		users = append(users, client.User())
+	}
+	return users
+}
+
+// requestNickSnapshot asks the hub to send conn a full nick list, or just a
+// checksum of it when full is false.
+func (h *Hub) requestNickSnapshot(conn *ServerConnection, full bool) {
+	h.nickSnapshots <- nickSnapshotRequest{conn: conn, full: full}
+}
+
+func (h *Hub) applyUserDelta(req remoteUserDeltaRequest) {
+	nick := normalizeUsername(req.nick)
+	h.mu.Lock()
+	if req.joined {
+		h.warnOnDuplicateNick(req.serverAddr, nick, req.route.Path)
+		h.setRoute(req.serverAddr, nick, req.route)
+	} else {
+		delete(h.remoteNicks[req.serverAddr], nick)
+	}
+	h.mu.Unlock()
+
+	if req.joined {
+		h.resolveNickConflict(nick)
+	}
+	h.syncAdvertisements()
+}
+
+func (h *Hub) getRoomList() []roomSummary {
+	respChan := make(chan []roomSummary)
+	h.requestRooms <- respChan
+	return <-respChan
+}
+
+func (h *Hub) requestRoomChange(client *Client, room string) {
+	h.changeRoom <- roomChangeRequest{
+		client: client,
+		room:   normalizeRoomName(room),
+	}
+}
+
+// sendPrivateMessage delivers msg to targetUser. A non-empty targetServer
+// restricts delivery to the user on that server.
+func (h *Hub) sendPrivateMessage(targetUser, targetServer string, msg Message, sender *Client) {
 	payload := privateMessagePayload{
-		TargetUser: normalizeUsername(targetUser),
-		Message:    msg,
-		Sender:     sender,
+		TargetUser:   normalizeUsername(targetUser),
+		TargetServer: normalizeServerName(targetServer),
+		Message:      msg,
+		Sender:       sender,
 	}
 	h.privateMsgChan <- payload
 }
 
-func (h *Hub) findServerForNick(nick string) (string, bool) {
-	nick = normalizeUsername(nick)
-	for serverAddr, nicks := range h.remoteNicks {
-		for _, n := range nicks {
-			if n == nick {
-				return serverAddr, true
-			}
-		}
+// notifyLinkLost tells the hub that the federation link to serverAddr is gone.
+func (h *Hub) notifyLinkLost(serverAddr string) {
+	h.linkLost <- serverAddr
+}
+
+// handleNetsplit forgets every nick learned from serverAddr and tells local
+// users who went away with it.
+func (h *Hub) handleNetsplit(serverAddr string) {
+	h.mu.Lock()
+	nicks := h.remoteNickNames(serverAddr)
+	delete(h.remoteNicks, serverAddr)
+	delete(h.advertised, serverAddr)
+	h.splitPeers[serverAddr] = true
+	h.mu.Unlock()
+
+	// Routes that went through the lost peer are gone; tell the others.
+	h.syncAdvertisements()
+
+	log.Printf("Netsplit: lost federation link to %s (%d users)", serverAddr, len(nicks))
+	if len(nicks) == 0 {
+		return
 	}
-	return "", false
+	h.deliverLocal(SystemMessage(fmt.Sprintf("Netsplit: lost link to %s. Left: %s", serverAddr, strings.Join(nicks, ", "))))
+}
+
+// applyNickSync replaces the nick list for a peer and announces a netjoin if
+// this is the first sync since the peer split off.
+func (h *Hub) applyNickSync(req nickSyncRequest) {
+	h.mu.Lock()
+	normalizedNicks := make([]string, 0, len(req.nicks))
+	for _, nick := range req.nicks {
+		normalizedNicks = append(normalizedNicks, normalizeUsername(nick))
+	}
+	// Check for name conflicts before updating
+	delete(h.remoteNicks, req.serverAddr)
+	for i, newNick := range normalizedNicks {
+		h.warnOnDuplicateNick(req.serverAddr, newNick, req.routes[req.nicks[i]].Path)
+	}
+	h.remoteNicks[req.serverAddr] = make(map[string]nickRoute)
+	for i, nick := range normalizedNicks {
+		h.setRoute(req.serverAddr, nick, req.routes[req.nicks[i]])
+	}
+	rejoined := h.splitPeers[req.serverAddr]
+	delete(h.splitPeers, req.serverAddr)
+	h.mu.Unlock()
+
+	for _, nick := range normalizedNicks {
+		h.resolveNickConflict(nick)
+	}
+
+	h.syncAdvertisements()
+
+	if !rejoined {
+		return
+	}
+	log.Printf("Netjoin: federation link to %s restored", req.serverAddr)
+	if len(normalizedNicks) == 0 {
+		h.deliverLocal(SystemMessage(fmt.Sprintf("Netjoin: %s is back.", req.serverAddr)))
+		return
+	}
+	h.deliverLocal(SystemMessage(fmt.Sprintf("Netjoin: %s is back. Rejoined: %s", req.serverAddr, strings.Join(normalizedNicks, ", "))))
+}
+
+// findServerForNick returns the direct peer on the shortest route to nick.
+func (h *Hub) findServerForNick(nick string) (string, bool) {
+	serverAddr, _, ok := h.bestRoute(nick)
+	return serverAddr, ok
 }
 
 func (h *Hub) isNameTakenInFederation(name string) bool {
@@ -112,14 +313,8 @@ func (h *Hub) isNameTakenInFederation(name string) bool {
 	}
 
 	// Check remote users
-	for _, nicks := range h.remoteNicks {
-		for _, nick := range nicks {
-			if nick == name {
-				return true
-			}
-		}
-	}
-	return false
+	_, found := h.findServerForNick(name)
+	return found
 }
 
 func (h *Hub) requestNameChange(client *Client, newName string, isGitHubAuth bool) {
@@ -142,138 +337,293 @@ func (h *Hub) sendToClient(client *Client, msg Message) bool {
 		log.Printf("client %s send channel full, disconnecting", client.User())
 		close(client.send)
 		delete(h.clients, client)
+		delete(h.waiting, client)
 		delete(h.clientsByName, client.User())
+		h.removeFromRoom(client)
+		h.syncAdvertisements()
 		return false
 	}
 }
 
+func (h *Hub) addToRoom(client *Client, room string) {
+	members, ok := h.rooms[room]
+	if !ok {
+		members = make(map[*Client]bool)
+		h.rooms[room] = members
+	}
+	members[client] = true
+	client.SetRoom(room)
+}
+
+func (h *Hub) removeFromRoom(client *Client) {
+	room := client.Room()
+	members, ok := h.rooms[room]
+	if !ok {
+		return
+	}
+	delete(members, client)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// deliverLocal sends a message to the members of its room, or to every
+// local client when the message has no room.
+func (h *Hub) deliverLocal(msg Message) {
+	if msg.Room == "" {
+		for c := range h.clients {
+			h.sendToClient(c, msg)
+		}
+		return
+	}
+
+	for c := range h.rooms[msg.Room] {
+		h.sendToClient(c, msg)
+	}
+}
+
+func (h *Hub) moveClientToRoom(client *Client, room string) {
+	oldRoom := client.Room()
+	if oldRoom == room {
+		h.sendToClient(client, SystemMessage(fmt.Sprintf("You are already in %s.", room)))
+		return
+	}
+
+	h.removeFromRoom(client)
+	if oldRoom != "" {
+		h.deliverLocal(Message{Author: "System", Content: fmt.Sprintf("%s has left %s.", client.User(), oldRoom), Type: "system", Room: oldRoom})
+	}
+
+	h.addToRoom(client, room)
+	h.deliverLocal(Message{Author: "System", Content: fmt.Sprintf("%s has joined %s.", client.User(), room), Type: "system", Room: room})
+}
+
+func (h *Hub) roomSummaries() []roomSummary {
+	summaries := make([]roomSummary, 0, len(h.rooms))
+	for name, members := range h.rooms {
+		summaries = append(summaries, roomSummary{Name: name, Members: len(members)})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries
+}
+
+// admit lets a client into the chat under a name no one else here holds,
+// and announces it.
+func (h *Hub) admit(client *Client) {
+	finalName := client.User()
+	for _, exists := h.clientsByName[finalName]; exists; _, exists = h.clientsByName[finalName] {
+		finalName = generateAnonymousName()
+	}
+	client.SetUser(finalName)
+	client.SetNickClock(h.tickClock())
+
+	h.clients[client] = true
+	h.clientsByName[client.User()] = client
+	h.addToRoom(client, defaultRoom)
+	log.Printf("Client registered: %s", client.User())
+	h.syncAdvertisements()
+	h.deliverLocal(Message{Author: "System", Content: client.User() + " has joined.", Type: "system", Room: defaultRoom})
+}
+
+// admitAuthenticated lets a client held by the blocked policy into the chat
+// once it has proved its GitHub login, under that login. Until the name is
+// its own the client stays outside; a local anonymous holder of the name is
+// renamed, as for any GitHub claim.
+func (h *Hub) admitAuthenticated(req nameChangeRequest) {
+	if !req.isGitHubAuth {
+		return
+	}
+	h.mu.Lock()
+	_, remoteHolder, nameTakenRemotely := h.bestRoute(req.newName)
+	h.mu.Unlock()
+	if nameTakenRemotely && remoteHolder.Authed {
+		h.sendToClient(req.client, SystemMessage(fmt.Sprintf("Name '%s' is already taken on %s.", req.newName, remoteHolder.Server)))
+		return
+	}
+
+	if existingClient, taken := h.clientsByName[req.newName]; taken {
+		h.releaseName(existingClient)
+	}
+
+	delete(h.waiting, req.client)
+	req.client.SetUser(req.newName)
+	req.client.SetIsAuthed(true)
+	h.admit(req.client)
+	h.grantRole(req.client)
+}
+
+// releaseName gives a client whose name an authenticating user claims an
+// anonymous name instead, and announces the rename here and to the peers.
+func (h *Hub) releaseName(client *Client) {
+	oldName := client.User()
+	newAnonName := generateAnonymousName()
+	for _, exists := h.clientsByName[newAnonName]; exists; _, exists = h.clientsByName[newAnonName] {
+		newAnonName = generateAnonymousName()
+	}
+
+	delete(h.clientsByName, oldName)
+	h.clientsByName[newAnonName] = client
+	client.SetUser(newAnonName)
+	client.SetIsAuthed(false) // Reset auth status
+	client.SetNickClock(h.tickClock())
+	h.sendToClient(client, SystemMessage(fmt.Sprintf("Your name was changed to %s because an authenticating user claimed the name '%s'.", newAnonName, oldName)))
+
+	renamed := SystemMessage(fmt.Sprintf("%s has been renamed to %s.", oldName, newAnonName))
+	for c := range h.clients {
+		h.sendToClient(c, renamed)
+	}
+	h.federation.BroadcastNameChange(oldName, newAnonName, false, client.NickClock())
+	h.holdIfBlocked(client)
+}
+
+// holdIfBlocked takes a client that has just lost its GitHub auth out of the
+// chat again when the blocked policy keeps anonymous users out.
+func (h *Hub) holdIfBlocked(client *Client) {
+	if h.anonymousPolicy != anonymousBlocked || client.IsAuthed() || !h.clients[client] {
+		return
+	}
+	room := client.Room()
+	delete(h.clients, client)
+	delete(h.clientsByName, client.User())
+	h.removeFromRoom(client)
+	h.waiting[client] = true
+	log.Printf("Client waiting for authentication: %s", client.User())
+	h.sendToClient(client, SystemMessage("This server only admits GitHub users. Use /gh to authenticate and join the chat again."))
+	h.syncAdvertisements()
+	h.deliverLocal(Message{Author: "System", Content: client.User() + " has left.", Type: "system", Room: room})
+}
+
 func (h *Hub) run() {
 	for {
 		select {
 		case client := <-h.register:
-			// Ensure the initial anonymous name doesn't conflict
-			finalName := client.User()
-			for _, exists := h.clientsByName[finalName]; exists; _, exists = h.clientsByName[finalName] {
-				finalName = generateAnonymousName()
+			if h.disconnectIfBanned(client) {
+				continue
 			}
-			client.SetUser(finalName)
-
-			h.clients[client] = true
-			h.clientsByName[client.User()] = client
-			log.Printf("Client registered: %s", client.User())
-			joinMsg := Message{Author: "System", Content: client.User() + " has joined.", Type: "system"}
-			for c := range h.clients {
-				h.sendToClient(c, joinMsg)
+			if h.anonymousPolicy == anonymousBlocked && !client.IsAuthed() {
+				// Held outside the chat until /gh succeeds.
+				h.waiting[client] = true
+				log.Printf("Client waiting for authentication: %s", client.User())
+				continue
 			}
+			h.admit(client)
 
 		case client := <-h.unregister:
+			if h.waiting[client] {
+				delete(h.waiting, client)
+				close(client.send)
+				continue
+			}
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				delete(h.clientsByName, client.User())
+				room := client.Room()
+				h.removeFromRoom(client)
 				close(client.send)
 				log.Printf("Client unregistered: %s", client.User())
-				leaveMsg := Message{Author: "System", Content: client.User() + " has left.", Type: "system"}
-				for c := range h.clients {
-					h.sendToClient(c, leaveMsg)
-				}
+				h.syncAdvertisements()
+				h.deliverLocal(Message{Author: "System", Content: client.User() + " has left.", Type: "system", Room: room})
 			}
 
 		case message := <-h.broadcast:
-			for client := range h.clients {
-				h.sendToClient(client, message)
+			if message.Type == "public" && h.refuseIfMuted(h.clientsByName[message.Author]) {
+				continue
+			}
+			if message.Type == "public" && message.ID == "" {
+				message.ID = newMessageID()
+				h.markSeen(message.ID)
+			}
+			h.deliverLocal(message)
+			if message.Type == "public" {
+				h.federation.BroadcastPublicMessage(message, 1, "")
 			}
 
+		case req := <-h.remoteBroadcast:
+			// Flooded through the federation; drop copies that took another path.
+			if !h.markSeen(req.message.ID) {
+				continue
+			}
+			if req.message.Server == "" {
+				req.message.Server = h.serverOfNick(req.message.Author)
+			}
+			h.deliverLocal(req.message)
+			if req.hops < federationMaxHops {
+				h.federation.BroadcastPublicMessage(req.message, req.hops+1, req.serverAddr)
+			}
+
+		case req := <-h.changeRoom:
+			if _, ok := h.clients[req.client]; ok {
+				h.moveClientToRoom(req.client, req.room)
+			}
+
+		case respChan := <-h.requestRooms:
+			respChan <- h.roomSummaries()
+
 		case respChan := <-h.requestUsers:
 			var users []string
 			for client := range h.clients {
-				users = append(users, client.User())
-			}
-			for _, nicks := range h.remoteNicks {
-				users = append(users, nicks...)
+				users = append(users, userLabel(client.User(), client.IsAuthed()))
 			}
+			users = append(users, h.remoteUserLabels()...)
 			respChan <- users
 
 		case respChan := <-h.requestLocalUsers:
 			h.mu.RLock()
-			var users []string
-			for client := range h.clients {
-				users = append(users, client.User())
-			}
-			respChan <- users
+			respChan <- h.localUserNames()
 			h.mu.RUnlock()
 
-		case pMsg := <-h.privateMsgChan:
+		case req := <-h.remoteUserDelta:
+			h.applyUserDelta(req)
+
+		case req := <-h.verifyNicks:
 			h.mu.RLock()
-			targetClient, found := h.clientsByName[pMsg.TargetUser]
-			if found {
-				if pMsg.Sender != nil && targetClient == pMsg.Sender {
-					h.sendToClient(pMsg.Sender, Message{Type: "system", Content: "You can't send a message to yourself."})
-					h.mu.RUnlock()
-					continue
-				}
+			localView := nickChecksum(h.remoteNickNames(req.conn.addr))
+			h.mu.RUnlock()
+			if localView != req.checksum {
+				log.Printf("Nick list for %s has drifted; requesting a snapshot", req.conn.addr)
+				req.conn.sendNickSyncRequest()
+			}
 
-				targetMsg := Message{
-					Type:    "private",
-					Content: fmt.Sprintf("(from %s): %s", pMsg.Message.Author, pMsg.Message.Content),
-				}
-				h.sendToClient(targetClient, targetMsg)
+		case req := <-h.nickSnapshots:
+			h.sendNickSnapshot(req.conn, req.full)
 
-				if pMsg.Sender != nil {
-					senderConfirmMsg := Message{
-						Type:    "private",
-						Content: fmt.Sprintf("(to %s): %s", pMsg.TargetUser, pMsg.Message.Content),
-					}
-					h.sendToClient(pMsg.Sender, senderConfirmMsg)
-				}
-			} else {
-				// Check remote users
-				foundRemote := false
-				for serverAddr, nicks := range h.remoteNicks {
-					for _, nick := range nicks {
-						if nick == pMsg.TargetUser {
-							for _, server := range h.federation.servers {
-								if server.addr == serverAddr {
-									server.sendPrivateMessage(pMsg.Message.Author, pMsg.TargetUser, pMsg.Message.Content)
-									foundRemote = true
-									break
-								}
-							}
-						}
-						if foundRemote {
-							break
-						}
-					}
-					if foundRemote {
-						break
-					}
-				}
-				if !foundRemote && pMsg.Sender != nil {
-					h.sendToClient(pMsg.Sender, Message{Type: "system", Content: fmt.Sprintf("User '%s' not found.", pMsg.TargetUser)})
-				}
-			}
+		case pMsg := <-h.privateMsgChan:
+			h.mu.RLock()
+			h.handlePrivateMessage(pMsg)
 			h.mu.RUnlock()
 
+		case receipt := <-h.privateReceipts:
+			h.handlePrivateReceipt(receipt)
+
+		case id := <-h.privateTimeouts:
+			h.expirePrivateMessage(id)
+
 		case req := <-h.changeName:
+			if req.isGitHubAuth {
+				if ban, banned := h.loginBan(req.newName); banned {
+					log.Printf("Moderation: refusing banned GitHub login %s", req.newName)
+					entry := sessionEntry(auditBannedConnection, req.client)
+					entry.Login, entry.Reason = req.newName, ban.Reason
+					h.auditLog().record(entry)
+					req.client.Disconnect(ban.describe())
+					continue
+				}
+			}
+			if h.waiting[req.client] {
+				h.admitAuthenticated(req)
+				continue
+			}
 			h.mu.Lock()
-			nameTakenInFederation := h.isNameTakenInFederation(req.newName)
 			existingClient, nameTakenLocally := h.clientsByName[req.newName]
+			_, remoteHolder, nameTakenRemotely := h.bestRoute(req.newName)
 			h.mu.Unlock()
 
-			if (nameTakenInFederation && req.client.User() != req.newName) || (nameTakenLocally && existingClient != req.client) {
+			if nameTakenLocally && existingClient != req.client {
 				if req.isGitHubAuth {
 					// GitHub auth takes precedence. Kick the existing user off the name.
-					kickedUserOldName := existingClient.User()
-					newAnonName := generateAnonymousName()
-					for _, exists := h.clientsByName[newAnonName]; exists; _, exists = h.clientsByName[newAnonName] {
-						newAnonName = generateAnonymousName()
-					}
-
-					// Update the kicked user's details
-					delete(h.clientsByName, kickedUserOldName)
-					h.clientsByName[newAnonName] = existingClient
-					existingClient.SetUser(newAnonName)
-					existingClient.SetIsAuthed(false) // Reset auth status
-					h.sendToClient(existingClient, SystemMessage(fmt.Sprintf("Your name was changed to %s because an authenticating user claimed the name '%s'.", newAnonName, kickedUserOldName)))
+					h.releaseName(existingClient)
 
 					// Now the name is free, proceed to update the authenticating user
 					oldAuthName := req.client.User()
@@ -281,39 +631,55 @@ func (h *Hub) run() {
 					h.clientsByName[req.newName] = req.client
 					req.client.SetUser(req.newName)
 					req.client.SetIsAuthed(true) // Set auth status
+					h.grantRole(req.client)
+					req.client.SetNickClock(h.tickClock())
 
-					// Broadcast both changes
-					broadcastMsg1 := SystemMessage(fmt.Sprintf("%s has been renamed to %s.", kickedUserOldName, newAnonName))
-					broadcastMsg2 := SystemMessage(fmt.Sprintf("%s has authenticated and is now known as %s.", oldAuthName, req.newName))
+					broadcastMsg := SystemMessage(fmt.Sprintf("%s has authenticated and is now known as %s.", oldAuthName, req.newName))
 					for c := range h.clients {
-						h.sendToClient(c, broadcastMsg1)
-						h.sendToClient(c, broadcastMsg2)
+						h.sendToClient(c, broadcastMsg)
 					}
 
-					// Notify federation about the changes
-					h.federation.BroadcastNameChange(kickedUserOldName, newAnonName, false)
-					h.federation.BroadcastNameChange(oldAuthName, req.newName, true)
+					h.federation.BroadcastNameChange(oldAuthName, req.newName, true, req.client.NickClock())
+					h.syncAdvertisements()
+					h.resolveNickConflict(req.newName)
 
 				} else {
 					// Normal name change, name is taken. Reject.
 					h.sendToClient(req.client, SystemMessage(fmt.Sprintf("Name '%s' is already taken.", req.newName)))
 				}
+			} else if nameTakenRemotely && (!req.isGitHubAuth || remoteHolder.Authed) {
+				// Only a GitHub claim can displace a remote user, and only an
+				// anonymous one: between two GitHub claims the earlier one wins.
+				h.sendToClient(req.client, SystemMessage(fmt.Sprintf("Name '%s' is already taken on %s.", req.newName, remoteHolder.Server)))
 			} else {
 				// Name is not taken or user is re-setting their own name.
 				oldName := req.client.User()
 				if oldName == req.newName {
-					continue // No change
+					// No change of name, but a /gh for the current one still
+					// signs the user in and applies any role configured since.
+					if req.isGitHubAuth {
+						wasAuthed := req.client.IsAuthed()
+						req.client.SetIsAuthed(true)
+						h.grantRole(req.client)
+						if !wasAuthed {
+							h.federation.BroadcastNameChange(oldName, oldName, true, req.client.NickClock())
+							h.syncAdvertisements()
+						}
+					}
+					continue
 				}
 
 				delete(h.clientsByName, oldName)
 				h.clientsByName[req.newName] = req.client
 				req.client.SetUser(req.newName)
+				req.client.SetNickClock(h.tickClock())
 
 				// If user is just renaming, they lose their GitHub auth status unless it's their GitHub name
 				if !req.isGitHubAuth {
 					req.client.SetIsAuthed(false)
 				} else {
 					req.client.SetIsAuthed(true)
+					h.grantRole(req.client)
 				}
 
 				// Broadcast the change.
@@ -322,55 +688,64 @@ func (h *Hub) run() {
 					h.sendToClient(c, broadcastMsg)
 				}
 
-				h.federation.BroadcastNameChange(oldName, req.newName, req.isGitHubAuth)
+				h.federation.BroadcastNameChange(oldName, req.newName, req.isGitHubAuth, req.client.NickClock())
+				h.syncAdvertisements()
+				h.holdIfBlocked(req.client)
 			}
 		case req := <-h.syncNicks:
-			h.mu.Lock()
-			normalizedNicks := make([]string, 0, len(req.nicks))
-			for _, nick := range req.nicks {
-				normalizedNicks = append(normalizedNicks, normalizeUsername(nick))
-			}
-			// Check for name conflicts before updating
-			for _, newNick := range normalizedNicks {
-				// Skip if the nick is from the same server we're updating
-				if currentServer, exists := h.findServerForNick(newNick); exists && currentServer != req.serverAddr {
-					log.Printf("Warning: User %s exists on multiple servers (%s and %s)", newNick, currentServer, req.serverAddr)
-				}
-			}
-			h.remoteNicks[req.serverAddr] = normalizedNicks
-			h.mu.Unlock()
+			h.applyNickSync(req)
+
+		case action := <-h.moderation:
+			h.issueModeration(action)
+
+		case req := <-h.moderationRequests:
+			h.handleModerationRequest(req)
+
+		case req := <-h.remoteModeration:
+			h.handleRemoteModeration(req)
+
+		case req := <-h.floodMutes:
+			h.muteFlooder(req)
+
+		case serverAddr := <-h.linkLost:
+			h.handleNetsplit(serverAddr)
 
 		case req := <-h.remoteNameChange:
+			if !h.markSeen(req.id) {
+				continue
+			}
 			req.oldName = normalizeUsername(req.oldName)
 			req.newName = normalizeUsername(req.newName)
 			h.mu.Lock()
-			for i, nick := range h.remoteNicks[req.serverAddr] {
-				if nick == req.oldName {
-					h.remoteNicks[req.serverAddr] = append(h.remoteNicks[req.serverAddr][:i], h.remoteNicks[req.serverAddr][i+1:]...)
-					break
-				}
+			route, known := h.remoteNicks[req.serverAddr][req.oldName]
+			delete(h.remoteNicks[req.serverAddr], req.oldName)
+			if !known {
+				route = nickRoute{}
 			}
-			// Add the new nick
-			h.remoteNicks[req.serverAddr] = append(h.remoteNicks[req.serverAddr], req.newName)
-
-			// If github auth, check for local users with the same name
-			if req.isGitHubAuth {
-				if client, ok := h.clientsByName[req.newName]; ok {
-					// Kick the local user
-					kickedUserOldName := client.User()
-					newAnonName := generateAnonymousName()
-					for _, exists := h.clientsByName[newAnonName]; exists; _, exists = h.clientsByName[newAnonName] {
-						newAnonName = generateAnonymousName()
-					}
-					delete(h.clientsByName, kickedUserOldName)
-					h.clientsByName[newAnonName] = client
-					client.SetUser(newAnonName)
-					client.SetIsAuthed(false)
-					h.sendToClient(client, SystemMessage(fmt.Sprintf("Your name was changed to %s because an authenticating user claimed the name '%s'.", newAnonName, kickedUserOldName)))
-					h.federation.BroadcastNameChange(kickedUserOldName, newAnonName, false)
-				}
+			route.Clock = req.clock
+			route.Authed = req.isGitHubAuth
+			route.Provider = req.provider
+			if req.isGitHubAuth && route.Provider == "" {
+				route.Provider = authProviderGitHub
 			}
+			h.setRoute(req.serverAddr, req.newName, route)
 			h.mu.Unlock()
+
+			// A local user holding the new name is renamed if the remote claim wins.
+			h.resolveNickConflict(req.newName)
+
+			if req.hops < federationMaxHops {
+				h.federation.relayNameChange(NameChangePayload{
+					OldName:      req.oldName,
+					NewName:      req.newName,
+					IsGitHubAuth: req.isGitHubAuth,
+					Provider:     req.provider,
+					Clock:        req.clock,
+					ID:           req.id,
+					Hops:         req.hops + 1,
+				}, req.serverAddr)
+			}
+			h.syncAdvertisements()
 		}
 	}
 }
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/charmbracelet/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
 )
 
 func main() {
@@ -51,8 +52,37 @@ func main() {
 	}
 	cfg.Federation.KnownHostsPath = safeKnownHostsPath
 
+	safeBanListPath, err := sanitizePathInBase(cfg.Bans.Path, hostKeyBase, "ban list path")
+	if err != nil {
+		log.Fatalf("Invalid ban list path in config: %v", err)
+	}
+	bans, err := loadBanList(safeBanListPath)
+	if err != nil {
+		log.Fatalf("Failed to load ban list: %v", err)
+	}
+
+	var audit *AuditLog
+	if strings.TrimSpace(cfg.Audit.Path) != "" {
+		safeAuditPath, err := sanitizePathInBase(cfg.Audit.Path, hostKeyBase, "audit log path")
+		if err != nil {
+			log.Fatalf("Invalid audit log path in config: %v", err)
+		}
+		audit, err = openAuditLog(safeAuditPath, int64(cfg.Audit.MaxSizeMB)<<20, cfg.Audit.Keep)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer audit.Close()
+	}
+
+	hostSigner := getHostKey(safeHostKeyPath)
+
 	hub := newHub()
-	federation, err := NewFederation(hub, cfg.Federation.Servers, safeKnownHostsPath, cfg.Federation.SharedSecret)
+	hub.showServerNames = cfg.Chat.ShowServerNames
+	hub.roles = cfg.roles()
+	hub.bans = bans
+	hub.audit = audit
+	hub.anonymousPolicy = cfg.anonymousPolicy()
+	federation, err := NewFederation(hub, cfg.Federation, hostSigner)
 	if err != nil {
 		log.Fatalf("Failed to initialize federation: %v", err)
 	}
@@ -61,9 +91,41 @@ func main() {
 
 	federation.Start()
 
+	server := newSSHServer(cfg, hub, federation, hostSigner)
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+
+	log.Printf("Starting SoftRoom SSH server at %s:%d", cfg.Server.Host, cfg.Server.Port)
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != ssh.ErrServerClosed {
+			log.Fatalf("Could not start SSH server: %v", err)
+		}
+	}()
+
+	<-done
+	log.Println("Server is shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Fatalf("Server shutdown failed: %+v", err)
+	}
+}
+
+// newSSHServer wires chat sessions, control commands and federation
+// channels into an SSH server for hub.
+func newSSHServer(cfg *Config, hub *Hub, federation *Federation, hostSigner ssh.Signer) *ssh.Server {
 	sshHandler := func(s ssh.Session) {
 		if s.User() == "federation" {
-			hub.federation.HandleNewServer(s)
+			// Federation traffic uses its own channel type, never a shell session.
+			_ = s.Close()
+			return
+		}
+
+		if len(s.Command()) > 0 {
+			handleControlSession(s, federation, cfg)
 			return
 		}
 
@@ -79,8 +141,24 @@ func main() {
 		initialName := generateAnonymousName()
 		client := NewClient(s, hub, "", sio.input, sio.output)
 		client.SetUser(initialName)
+		client.limiter = newRateLimiter(cfg.Limits)
+		if ban, banned := hub.bans.forClient(client); banned {
+			log.Printf("Refusing banned session from %s", s.RemoteAddr())
+			entry := sessionEntry(auditBannedConnection, client)
+			entry.Reason = ban.Reason
+			hub.auditLog().record(entry)
+			fmt.Fprintln(s, ban.describe())
+			_ = s.Close()
+			return
+		}
 
 		welcomeText := fmt.Sprintf("Welcome, %s! Use /n <newname> to change your name, or /gh to authenticate with GitHub.", initialName)
+		switch cfg.anonymousPolicy() {
+		case anonymousReadOnly:
+			welcomeText = fmt.Sprintf("Welcome, %s! Anonymous users can only read here; use /gh to authenticate with GitHub and post.", initialName)
+		case anonymousBlocked:
+			welcomeText = "Welcome! This server only admits GitHub users. Use /gh to authenticate and join the chat."
+		}
 		client.EnqueueMessage(SystemMessage(welcomeText))
 
 		hub.register <- client
@@ -89,36 +167,32 @@ func main() {
 
 		hub.unregister <- client
 	}
-	server := ssh.Server{
+	return &ssh.Server{
 		Addr:    fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
 		Handler: sshHandler,
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":             ssh.DefaultSessionHandler,
+			federationChannelType: federation.HandleChannel,
+		},
 		PtyCallback: func(ctx ssh.Context, pty ssh.Pty) bool {
 			return true
 		},
+		// Federation peers must present a configured key. Chat users may log in
+		// with any key, or with an empty keyboard-interactive exchange if they
+		// have none.
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			if ctx.User() == "federation" {
+				return federation.IsPeerKey(key)
+			}
+			return true
+		},
+		KeyboardInteractiveHandler: func(ctx ssh.Context, challenger cryptossh.KeyboardInteractiveChallenge) bool {
+			return ctx.User() != "federation"
+		},
 		HostSigners: []ssh.Signer{
-			getHostKey(safeHostKeyPath),
+			hostSigner,
 		},
 	}
-
-	done := make(chan os.Signal, 1)
-	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-
-	log.Printf("Starting SoftRoom SSH server at %s:%d", cfg.Server.Host, cfg.Server.Port)
-
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != ssh.ErrServerClosed {
-			log.Fatalf("Could not start SSH server: %v", err)
-		}
-	}()
-
-	<-done
-	log.Println("Server is shutting down...")
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server shutdown failed: %+v", err)
-	}
 }
 
 func mustGetwd() string {
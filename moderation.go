@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Moderation actions target a user by GitHub login, SSH key fingerprint, IP
+// address or range, or a combination. Kicks end the user's current session;
+// mutes and bans stay in force until they expire, for the user's current and
+// later sessions. Bans are kept in the BanList and survive restarts.
+
+const (
+	moderationKick = "kick"
+	moderationMute = "mute"
+	moderationBan  = "ban"
+)
+
+// Roles are granted from the [moderators] and [admins] lists once a user
+// proves their GitHub login with /gh.
+const (
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// roleRank orders roles: a user may only moderate users ranked below them.
+func roleRank(role string) int {
+	switch role {
+	case roleAdmin:
+		return 2
+	case roleModerator:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// moderationRequest is a /kick, /mute or /ban typed by a user. The hub
+// checks the issuer's role and resolves the target.
+type moderationRequest struct {
+	issuer   *Client
+	action   string
+	target   string
+	server   string // Set when the target was given as nick@server
+	duration time.Duration
+	reason   string
+}
+
+type moderationAction struct {
+	ID          string    `json:"id"`
+	Action      string    `json:"action"`
+	Issuer      string    `json:"issuer"`                // Moderator who issued it
+	Server      string    `json:"server,omitempty"`      // Name of the server it was issued on
+	Login       string    `json:"login,omitempty"`       // GitHub login of the target, if known
+	Fingerprint string    `json:"fingerprint,omitempty"` // SSH key fingerprint of the target, if known
+	Network     string    `json:"network,omitempty"`     // IP range of the target as a CIDR prefix; never federated
+	Reason      string    `json:"reason,omitempty"`
+	Expires     time.Time `json:"expires,omitzero"` // Zero for kicks and permanent mutes and bans
+	session     *Client   // Set to target only this session; never saved or federated
+}
+
+func isModerationAction(action string) bool {
+	return action == moderationKick || action == moderationMute || action == moderationBan
+}
+
+// matches reports whether the action targets c. Logins only match users who
+// proved them through GitHub.
+func (a moderationAction) matches(c *Client) bool {
+	if a.session != nil {
+		return a.session == c
+	}
+	login := ""
+	if c.IsAuthed() {
+		login = c.User()
+	}
+	return a.matchesIdentity(login, c.KeyFingerprint(), c.RemoteAddr())
+}
+
+// matchesIdentity is matches for a session that may not have a Client yet.
+// login must be "" unless the user proved it.
+func (a moderationAction) matchesIdentity(login, fingerprint string, addr netip.Addr) bool {
+	if a.Login != "" && login != "" && strings.EqualFold(a.Login, login) {
+		return true
+	}
+	if a.Fingerprint != "" && a.Fingerprint == fingerprint {
+		return true
+	}
+	if a.Network == "" || !addr.IsValid() {
+		return false
+	}
+	prefix, err := netip.ParsePrefix(a.Network)
+	return err == nil && prefix.Contains(addr.Unmap())
+}
+
+// identify points the action at c's GitHub login and key. A mute or ban on
+// a user with neither falls back to their address.
+func (a *moderationAction) identify(c *Client) {
+	if c.IsAuthed() {
+		a.Login = c.User()
+	}
+	a.Fingerprint = c.KeyFingerprint()
+	if a.Login == "" && a.Fingerprint == "" && a.Action != moderationKick {
+		if addr := c.RemoteAddr(); addr.IsValid() {
+			a.Network = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+	}
+}
+
+func (a moderationAction) expired(now time.Time) bool {
+	return !a.Expires.IsZero() && now.After(a.Expires)
+}
+
+// sameTarget reports whether a and b are the same kind of action against
+// the same identity, so the later one replaces the earlier.
+func (a moderationAction) sameTarget(b moderationAction) bool {
+	return a.Action == b.Action && strings.EqualFold(a.Login, b.Login) && a.Fingerprint == b.Fingerprint && a.Network == b.Network && a.session == b.session
+}
+
+var moderationVerbs = map[string]string{moderationKick: "kicked", moderationMute: "muted", moderationBan: "banned"}
+
+// announce tells everyone else that name was hit by the action.
+func (a moderationAction) announce(name string) string {
+	text := fmt.Sprintf("%s has been %s by %s", name, moderationVerbs[a.Action], a.Issuer)
+	if a.Server != "" {
+		text += "@" + a.Server
+	}
+	if a.Reason != "" {
+		text += ": " + a.Reason
+	}
+	return text + "."
+}
+
+// describe explains the action to its target.
+func (a moderationAction) describe() string {
+	text := fmt.Sprintf("You have been %s by %s", moderationVerbs[a.Action], a.Issuer)
+	if a.Server != "" {
+		text += "@" + a.Server
+	}
+	if !a.Expires.IsZero() {
+		text += fmt.Sprintf(" until %s", a.Expires.UTC().Format(time.RFC3339))
+	}
+	if a.Reason != "" {
+		text += ": " + a.Reason
+	}
+	return text + "."
+}
+
+// moderate applies an action issued on this server and sends it to the
+// federation.
+func (h *Hub) moderate(action moderationAction) {
+	h.moderation <- action
+}
+
+func (h *Hub) requestModeration(req moderationRequest) {
+	h.moderationRequests <- req
+}
+
+// issueModeration applies an action issued on this server and floods it.
+// Actions only on an address stay local: peers cannot see our users' IPs.
+func (h *Hub) issueModeration(action moderationAction) {
+	if action.ID == "" {
+		action.ID = newMessageID()
+	}
+	if action.Server == "" {
+		action.Server = h.selfName()
+	}
+	h.markSeen(action.ID)
+	h.applyModeration(action)
+	if action.Login != "" || action.Fingerprint != "" {
+		h.federation.BroadcastModeration(action)
+	}
+}
+
+// handleModerationRequest checks that the issuer may moderate the target and
+// turns the target's name into the identities the action is enforced on.
+func (h *Hub) handleModerationRequest(req moderationRequest) {
+	issuer := req.issuer
+	if !isModerator(issuer) {
+		h.sendToClient(issuer, SystemMessage(fmt.Sprintf("Only moderators can %s users.", req.action)))
+		return
+	}
+
+	action := moderationAction{Action: req.action, Issuer: issuer.User(), Server: h.selfName(), Reason: req.reason}
+	if req.duration > 0 && req.action != moderationKick {
+		action.Expires = time.Now().Add(req.duration)
+	}
+
+	if network, ok := parseBanNetwork(req.target); ok && req.server == "" {
+		if req.action == moderationKick {
+			h.sendToClient(issuer, SystemMessage("Kick users by name; addresses can only be muted or banned."))
+			return
+		}
+		action.Network = network
+		h.issueModeration(action)
+		h.sendToClient(issuer, SystemMessage(fmt.Sprintf("%s is now %s.", network, moderationVerbs[req.action])))
+		return
+	}
+
+	target, local := h.clientsByName[req.target]
+	if local && (req.server == "" || req.server == h.selfName()) {
+		if target == issuer {
+			h.sendToClient(issuer, SystemMessage(fmt.Sprintf("You cannot %s yourself.", req.action)))
+			return
+		}
+		if roleRank(target.Role()) >= roleRank(issuer.Role()) {
+			h.sendToClient(issuer, SystemMessage(fmt.Sprintf("You cannot %s %s.", req.action, target.User())))
+			return
+		}
+		action.identify(target)
+		if action.Login == "" && action.Fingerprint == "" && action.Network == "" {
+			// Nothing identifies the user beyond this session.
+			if req.action != moderationKick {
+				h.sendToClient(issuer, SystemMessage(fmt.Sprintf("%s has no GitHub login, SSH key or address to %s; kick them instead.", target.User(), req.action)))
+				return
+			}
+			action.ID = newMessageID()
+			h.enforceModeration(target, action)
+			return
+		}
+		h.issueModeration(action)
+		return
+	}
+
+	_, route, found := h.bestRoute(req.target)
+	if req.server != "" {
+		_, route, found = h.routeVia(req.target, req.server)
+	}
+	if !found {
+		h.sendToClient(issuer, SystemMessage(fmt.Sprintf("User '%s' not found.", h.displayName(req.target, req.server))))
+		return
+	}
+	if !route.Authed {
+		h.sendToClient(issuer, SystemMessage(fmt.Sprintf("%s is anonymous on %s; only that server can identify them.", req.target, route.Server)))
+		return
+	}
+	action.Login = req.target
+	h.issueModeration(action)
+	h.sendToClient(issuer, SystemMessage(fmt.Sprintf("Sent %s of %s@%s to the federation.", req.action, req.target, route.Server)))
+}
+
+// grantRole gives a user who just proved their GitHub login the role it is
+// listed with.
+func (h *Hub) grantRole(c *Client) {
+	role := h.roles[strings.ToLower(c.User())]
+	c.SetRole(role)
+	entry := sessionEntry(auditAuthSuccess, c)
+	entry.Role = role
+	h.auditLog().record(entry)
+	if role != "" {
+		h.sendToClient(c, SystemMessage(fmt.Sprintf("You are signed in as %s.", role)))
+	}
+}
+
+// applyModeration records a mute or ban and enforces the action on every
+// matching local user.
+func (h *Hub) applyModeration(action moderationAction) {
+	now := time.Now()
+	if action.expired(now) {
+		return
+	}
+	switch action.Action {
+	case moderationBan:
+		if err := h.bans.add(action); err != nil {
+			log.Printf("Failed to save ban list: %v", err)
+		}
+	case moderationMute:
+		kept := h.sanctions[:0]
+		for _, existing := range h.sanctions {
+			if !existing.sameTarget(action) && !existing.expired(now) {
+				kept = append(kept, existing)
+			}
+		}
+		h.sanctions = append(kept, action)
+	}
+
+	enforced := false
+	for c := range h.clients {
+		if action.matches(c) {
+			h.enforceModeration(c, action)
+			enforced = true
+		}
+	}
+	if !enforced && action.Action != moderationKick {
+		h.auditLog().record(moderationEntry(action, ""))
+	}
+}
+
+// applyRemoteModeration is applyModeration for an action issued on another
+// server, which never reaches local moderators and admins: a ban or mute that
+// matches one of them is not kept, and it is enforced only on the other
+// users it matches.
+func (h *Hub) applyRemoteModeration(action moderationAction) {
+	var spared []string
+	for c := range h.clients {
+		if action.matches(c) && roleRank(c.Role()) >= roleRank(roleModerator) {
+			spared = append(spared, c.User())
+		}
+	}
+	// Staff who are not signed in right now are known by their login.
+	if role := h.roles[strings.ToLower(action.Login)]; len(spared) == 0 && roleRank(role) >= roleRank(roleModerator) {
+		spared = append(spared, action.Login)
+	}
+	if len(spared) == 0 {
+		h.applyModeration(action)
+		return
+	}
+
+	log.Printf("Not keeping %s by %s@%s: it matches local staff %s", action.Action, action.Issuer, action.Server, strings.Join(spared, ", "))
+	if action.expired(time.Now()) {
+		return
+	}
+	for c := range h.clients {
+		if action.matches(c) && roleRank(c.Role()) < roleRank(roleModerator) {
+			h.enforceModeration(c, action)
+		}
+	}
+}
+
+// enforceModeration notifies c, disconnects it unless the action is a mute,
+// and announces it to everyone else.
+func (h *Hub) enforceModeration(c *Client, action moderationAction) {
+	log.Printf("Moderation: %s %s by %s@%s (%s)", action.Action, c.User(), action.Issuer, action.Server, action.Reason)
+	h.auditLog().record(moderationEntry(action, c.User()))
+	h.sendToClient(c, SystemMessage(action.describe()))
+	if action.Action != moderationMute {
+		c.Disconnect(action.describe())
+	}
+	announcement := SystemMessage(action.announce(c.User()))
+	for other := range h.clients {
+		if other != c {
+			h.sendToClient(other, announcement)
+		}
+	}
+}
+
+// muteFor returns the active mute that applies to c.
+func (h *Hub) muteFor(c *Client) (moderationAction, bool) {
+	now := time.Now()
+	for _, sanction := range h.sanctions {
+		if sanction.Action == moderationMute && !sanction.expired(now) && sanction.matches(c) {
+			return sanction, true
+		}
+	}
+	return moderationAction{}, false
+}
+
+// refuseIfMuted tells a muted client that its message was not sent.
+func (h *Hub) refuseIfMuted(c *Client) bool {
+	if c == nil {
+		return false
+	}
+	mute, muted := h.muteFor(c)
+	if muted {
+		h.sendToClient(c, SystemMessage(mute.describe()+" Your message was not sent."))
+	}
+	return muted
+}
+
+// disconnectIfBanned ends the session of a banned client.
+func (h *Hub) disconnectIfBanned(c *Client) bool {
+	ban, banned := h.bans.forClient(c)
+	if banned {
+		log.Printf("Moderation: refusing banned user %s", c.User())
+		entry := sessionEntry(auditBannedConnection, c)
+		entry.Reason = ban.Reason
+		h.auditLog().record(entry)
+		c.Disconnect(ban.describe())
+	}
+	return banned
+}
+
+// loginBan returns an active ban on a GitHub login, checked before a user
+// takes the login's name.
+func (h *Hub) loginBan(login string) (moderationAction, bool) {
+	return h.bans.find(login, "", netip.Addr{})
+}
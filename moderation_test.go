@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMutesAndBans(t *testing.T) {
+	h := newHub()
+	alice := &Client{user: "alice", send: make(chan Message, 10), fingerprint: "SHA256:alice"}
+	h.clients[alice] = true
+	h.clientsByName["alice"] = alice
+
+	h.applyModeration(moderationAction{Action: moderationMute, Issuer: "mod", Fingerprint: "SHA256:alice", Expires: time.Now().Add(time.Hour)})
+	if msg := <-alice.send; !strings.Contains(msg.Content, "You have been muted by mod until") {
+		t.Fatalf("alice got %q, want a mute notice", msg.Content)
+	}
+	if !h.refuseIfMuted(alice) {
+		t.Fatal("a muted user's messages should be refused")
+	}
+	if msg := <-alice.send; !strings.Contains(msg.Content, "Your message was not sent") {
+		t.Fatalf("alice got %q, want a refusal", msg.Content)
+	}
+	if alice.kickReason != "" {
+		t.Fatal("a mute must not disconnect the user")
+	}
+
+	h.sanctions[0].Expires = time.Now().Add(-time.Second)
+	if h.refuseIfMuted(alice) {
+		t.Fatal("an expired mute should not apply")
+	}
+
+	h.applyModeration(moderationAction{Action: moderationBan, Issuer: "mod", Login: "Bob", Reason: "spam"})
+	bob := &Client{user: "bob", send: make(chan Message, 10)}
+	if h.disconnectIfBanned(bob) {
+		t.Fatal("a login ban only applies once the user proves the login")
+	}
+	bob.SetIsAuthed(true)
+	if !h.disconnectIfBanned(bob) || !strings.Contains(bob.kickReason, "You have been banned by mod: spam.") {
+		t.Fatalf("banned login not refused, reason %q", bob.kickReason)
+	}
+	if _, banned := h.loginBan("bob"); !banned {
+		t.Fatal("loginBan should match logins case-insensitively")
+	}
+}
+
+func TestModerationRequestRoles(t *testing.T) {
+	h := newHub()
+	f, err := NewFederation(h, FederationConfig{ServerName: "alpha"}, nil)
+	if err != nil {
+		t.Fatalf("NewFederation error: %v", err)
+	}
+	h.federation = f
+	h.roles = map[string]string{"mod": roleModerator, "boss": roleAdmin}
+
+	join := func(name, fingerprint string, authed bool) *Client {
+		c := &Client{user: name, send: make(chan Message, 10), fingerprint: fingerprint}
+		c.SetIsAuthed(authed)
+		h.clients[c] = true
+		h.clientsByName[name] = c
+		if authed {
+			h.grantRole(c)
+		}
+		return c
+	}
+	mod := join("mod", "SHA256:mod", true)
+	boss := join("boss", "SHA256:boss", true)
+	troll := join("troll", "SHA256:troll", false)
+	ghost := join("ghost", "", false)
+
+	if msg := <-mod.send; msg.Content != "You are signed in as moderator." {
+		t.Fatalf("mod got %q, want the role granted", msg.Content)
+	}
+	<-boss.send
+
+	h.handleModerationRequest(moderationRequest{issuer: troll, action: moderationKick, target: "mod"})
+	if msg := <-troll.send; msg.Content != "Only moderators can kick users." {
+		t.Fatalf("troll got %q, want a refusal", msg.Content)
+	}
+	h.handleModerationRequest(moderationRequest{issuer: mod, action: moderationBan, target: "boss"})
+	if msg := <-mod.send; msg.Content != "You cannot ban boss." {
+		t.Fatalf("mod got %q, want a refusal to ban an admin", msg.Content)
+	}
+	h.handleModerationRequest(moderationRequest{issuer: mod, action: moderationMute, target: "mod", duration: time.Minute})
+	if msg := <-mod.send; msg.Content != "You cannot mute yourself." {
+		t.Fatalf("mod got %q, want a refusal to mute themselves", msg.Content)
+	}
+	h.handleModerationRequest(moderationRequest{issuer: mod, action: moderationMute, target: "ghost", duration: time.Minute})
+	if msg := <-mod.send; !strings.Contains(msg.Content, "kick them instead") {
+		t.Fatalf("mod got %q, want a refusal to mute a user without an identity", msg.Content)
+	}
+
+	h.handleModerationRequest(moderationRequest{issuer: mod, action: moderationMute, target: "troll", duration: time.Minute, reason: "flood"})
+	if msg := <-troll.send; !strings.HasPrefix(msg.Content, "You have been muted by mod@alpha until") {
+		t.Fatalf("troll got %q, want a mute notice", msg.Content)
+	}
+	if msg := <-boss.send; msg.Content != "troll has been muted by mod@alpha: flood." {
+		t.Fatalf("boss got %q, want an announcement", msg.Content)
+	}
+	if !h.refuseIfMuted(troll) {
+		t.Fatal("the mute should be recorded against troll's key")
+	}
+
+	h.handleModerationRequest(moderationRequest{issuer: boss, action: moderationKick, target: "ghost"})
+	if ghost.kickReason != "You have been kicked by boss@alpha." {
+		t.Fatalf("ghost kick reason = %q", ghost.kickReason)
+	}
+}
+
+func TestAddressBans(t *testing.T) {
+	h := newHub()
+	f, err := NewFederation(h, FederationConfig{ServerName: "alpha"}, nil)
+	if err != nil {
+		t.Fatalf("NewFederation error: %v", err)
+	}
+	h.federation = f
+	mod := &Client{user: "mod", send: make(chan Message, 10), isAuthed: true, role: roleModerator}
+	anon := &Client{user: "Anonymous1234", send: make(chan Message, 10), addr: netip.MustParseAddr("198.51.100.4")}
+	for _, c := range []*Client{mod, anon} {
+		h.clients[c] = true
+		h.clientsByName[c.user] = c
+	}
+
+	// An anonymous user without a key is banned by address.
+	h.handleModerationRequest(moderationRequest{issuer: mod, action: moderationBan, target: anon.user})
+	if !strings.Contains(anon.kickReason, "You have been banned by mod@alpha") {
+		t.Fatalf("anon kick reason = %q", anon.kickReason)
+	}
+	if ban, banned := h.bans.find("", "", netip.MustParseAddr("198.51.100.4")); !banned || ban.Network != "198.51.100.4/32" {
+		t.Fatalf("ban = %+v, want the user's address", ban)
+	}
+	if msg := <-mod.send; msg.Content != "Anonymous1234 has been banned by mod@alpha." {
+		t.Fatalf("mod got %q, want an announcement", msg.Content)
+	}
+
+	h.handleModerationRequest(moderationRequest{issuer: mod, action: moderationBan, target: "203.0.113.0/24", duration: time.Hour})
+	if msg := <-mod.send; msg.Content != "203.0.113.0/24 is now banned." {
+		t.Fatalf("mod got %q", msg.Content)
+	}
+	if _, banned := h.bans.find("", "", netip.MustParseAddr("203.0.113.200")); !banned {
+		t.Fatal("the range ban should be recorded")
+	}
+	h.handleModerationRequest(moderationRequest{issuer: mod, action: moderationKick, target: "203.0.113.1"})
+	if msg := <-mod.send; !strings.Contains(msg.Content, "addresses can only be muted or banned") {
+		t.Fatalf("mod got %q, want a refusal to kick an address", msg.Content)
+	}
+}
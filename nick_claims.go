@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"unicode/utf8"
+)
+
+// Two servers can hand out the same nick at the same time, for example while
+// they are split or when two users finish /gh simultaneously. Every claim on a
+// nick therefore carries a Lamport timestamp, and all servers rank competing
+// claims with the same rule: GitHub-authenticated claims first, then the
+// earliest timestamp, then the lowest home server ID. Only the loser's home
+// server renames it, to a name derived from the nick and that server's ID, so
+// every server ends up with the same result.
+
+// nickClaim is one server's claim on a nick.
+type nickClaim struct {
+	Clock  uint64 // Lamport timestamp of the claim
+	Authed bool   // Claimed through GitHub auth
+	Server string // ID of the claiming server
+}
+
+// beats reports whether c wins over other.
+func (c nickClaim) beats(other nickClaim) bool {
+	if c.Authed != other.Authed {
+		return c.Authed
+	}
+	if c.Clock != other.Clock {
+		return c.Clock < other.Clock
+	}
+	return c.Server < other.Server
+}
+
+func (r nickRoute) claim() nickClaim {
+	return nickClaim{Clock: r.Clock, Authed: r.Authed, Server: r.home()}
+}
+
+// tickClock advances the Lamport clock for a local claim.
+func (h *Hub) tickClock() uint64 {
+	h.clock++
+	return h.clock
+}
+
+// observeClock merges a timestamp seen from a peer into the Lamport clock.
+func (h *Hub) observeClock(clock uint64) {
+	if clock > h.clock {
+		h.clock = clock
+	}
+}
+
+func (h *Hub) localClaim(client *Client) nickClaim {
+	return nickClaim{Clock: client.NickClock(), Authed: client.IsAuthed(), Server: h.selfID()}
+}
+
+// conflictName is the name a losing claim on nick is renamed to. It depends
+// only on the nick and the loser's server ID, so it is the same everywhere.
+func conflictName(nick, serverID string) string {
+	suffix := serverID
+	if len(suffix) > 4 {
+		suffix = suffix[:4]
+	}
+	if suffix == "" {
+		suffix = "x"
+	}
+	maxNick := 20 - 1 - len(suffix)
+	for utf8.RuneCountInString(nick) > maxNick {
+		_, size := utf8.DecodeLastRuneInString(nick)
+		nick = nick[:len(nick)-size]
+	}
+	return nick + "-" + suffix
+}
+
+// resolveNickConflict renames the local holder of nick if a remote claim on
+// the same nick beats it. Conflicts between two remote servers are left to
+// the loser's home server; meanwhile bestRoute already prefers the winner.
+func (h *Hub) resolveNickConflict(nick string) {
+	client, ok := h.clientsByName[nick]
+	if !ok {
+		return
+	}
+	_, route, found := h.bestRoute(nick)
+	if !found || !route.claim().beats(h.localClaim(client)) {
+		return
+	}
+
+	newName := conflictName(nick, h.selfID())
+	for _, exists := h.clientsByName[newName]; exists; _, exists = h.clientsByName[newName] {
+		newName = generateAnonymousName()
+	}
+	log.Printf("Nick conflict on %s: %s has priority, renaming local user to %s", nick, route.Server, newName)
+
+	delete(h.clientsByName, nick)
+	h.clientsByName[newName] = client
+	client.SetUser(newName)
+	client.SetIsAuthed(false)
+	client.SetNickClock(h.tickClock())
+
+	h.sendToClient(client, SystemMessage(fmt.Sprintf("Your name was changed to %s because a user on %s has priority for the name '%s'.", newName, route.Server, nick)))
+	broadcastMsg := SystemMessage(fmt.Sprintf("%s has been renamed to %s.", nick, newName))
+	for c := range h.clients {
+		h.sendToClient(c, broadcastMsg)
+	}
+
+	h.federation.BroadcastNameChange(nick, newName, false, client.NickClock())
+	h.syncAdvertisements()
+	h.holdIfBlocked(client)
+}
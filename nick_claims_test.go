@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNickClaimOrdering(t *testing.T) {
+	early := nickClaim{Clock: 3, Server: "b"}
+	late := nickClaim{Clock: 7, Server: "a"}
+	authed := nickClaim{Clock: 9, Authed: true, Server: "c"}
+	tieLow := nickClaim{Clock: 3, Server: "a"}
+
+	cases := []struct {
+		winner, loser nickClaim
+	}{{early, late}, {authed, early}, {tieLow, early}}
+	for _, c := range cases {
+		if !c.winner.beats(c.loser) || c.loser.beats(c.winner) {
+			t.Fatalf("%+v should beat %+v, and not the other way round", c.winner, c.loser)
+		}
+	}
+
+	if got := conflictName("alice", "1a2b3c4d"); got != "alice-1a2b" {
+		t.Fatalf("conflictName = %q, want alice-1a2b", got)
+	}
+	if got := conflictName("averyveryverylongnick", "1a2b3c4d"); !isValidUsername(got) || got != conflictName("averyveryverylongnick", "1a2b3c4d") {
+		t.Fatalf("conflictName should be deterministic and valid, got %q", got)
+	}
+}
+
+func TestNickConflictRenamesLosingLocalUser(t *testing.T) {
+	h := newHub()
+	h.federation = &Federation{hub: h, serverID: "bbbb0000", serverName: "beta", nonces: newNonceCache(federationNonceTTL)}
+	peer := NewServerConnection("a:22", h, "", "secret")
+	out := &bytes.Buffer{}
+	peer.setConnection(out)
+	peer.setAuthenticated(true)
+	peer.peer = &peerInfo{ServerID: "aaaa0000", ServerName: "alpha", Capabilities: map[string]bool{"name_change": true}}
+	h.federation.servers = append(h.federation.servers, peer)
+
+	alice := &Client{user: "alice", send: make(chan Message, 10)}
+	alice.SetNickClock(5)
+	carol := &Client{user: "carol", send: make(chan Message, 10)}
+	carol.SetNickClock(1)
+	for _, c := range []*Client{alice, carol} {
+		h.clients[c] = true
+		h.clientsByName[c.User()] = c
+	}
+
+	// The remote alice was claimed earlier and wins; the remote carol loses.
+	h.applyUserDelta(remoteUserDeltaRequest{serverAddr: "a:22", nick: "alice", joined: true, route: nickRoute{Path: []string{"aaaa0000"}, Clock: 3}})
+	h.applyUserDelta(remoteUserDeltaRequest{serverAddr: "a:22", nick: "carol", joined: true, route: nickRoute{Path: []string{"aaaa0000"}, Clock: 4}})
+
+	if alice.User() != "alice-bbbb" {
+		t.Fatalf("losing local user is %q, want alice-bbbb", alice.User())
+	}
+	if h.clientsByName["alice-bbbb"] != alice {
+		t.Fatal("clientsByName should follow the rename")
+	}
+	if carol.User() != "carol" {
+		t.Fatalf("winning local user was renamed to %q", carol.User())
+	}
+	if !strings.Contains(out.String(), "alice-bbbb") {
+		t.Fatal("the rename should be announced to the federation")
+	}
+	if h.clock < 4 {
+		t.Fatalf("Lamport clock = %d, want it to observe remote claims", h.clock)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Federated DMs carry an ID. The server that finally delivers or rejects a DM
+// sends a private_message_ack or private_message_error back to the sender's
+// home server, routed like a DM, so the sender sees the same outcome as for a
+// local recipient. Senders whose next hop predates receipts get an
+// unconfirmed notice instead.
+
+const privateMessageAckTimeout = 30 * time.Second
+
+type PrivateMessageReceiptPayload struct {
+	ID        string `json:"id"`
+	To        string `json:"to"` // The DM's sender, who gets the receipt
+	ToServer  string `json:"to_server,omitempty"`
+	Recipient string `json:"recipient"`       // Addressee as the sender wrote it
+	Error     string `json:"error,omitempty"` // Empty for private_message_ack
+	Hops      int    `json:"hops,omitempty"`
+}
+
+// pendingPrivateMessage is a DM from a local user awaiting its receipt.
+type pendingPrivateMessage struct {
+	sender    *Client
+	recipient string
+	content   string
+}
+
+func privateTarget(pMsg privateMessagePayload) string {
+	if pMsg.TargetServer == "" {
+		return pMsg.TargetUser
+	}
+	return pMsg.TargetUser + "@" + pMsg.TargetServer
+}
+
+// handlePrivateMessage delivers a DM locally or forwards it to the next hop.
+func (h *Hub) handlePrivateMessage(pMsg privateMessagePayload) {
+	if h.refuseIfMuted(pMsg.Sender) {
+		return
+	}
+	targetClient, found := h.clientsByName[pMsg.TargetUser]
+	if pMsg.TargetServer != "" && pMsg.TargetServer != h.selfName() {
+		found = false
+	}
+	if found {
+		if pMsg.Sender != nil && targetClient == pMsg.Sender {
+			h.sendToClient(pMsg.Sender, Message{Type: "system", Content: "You can't send a message to yourself."})
+			return
+		}
+
+		fromServer := pMsg.Message.Server
+		if pMsg.Sender == nil && fromServer == "" {
+			fromServer = h.serverOfNick(pMsg.Message.Author)
+		}
+		targetMsg := Message{
+			Type:    "private",
+			Content: fmt.Sprintf("(from %s): %s", userLabel(h.displayName(pMsg.Message.Author, fromServer), pMsg.Message.AuthorIsAuthed), pMsg.Message.Content),
+		}
+		if !h.sendToClient(targetClient, targetMsg) {
+			h.failPrivateMessage(pMsg, "the recipient disconnected")
+			return
+		}
+
+		if pMsg.Sender != nil {
+			senderConfirmMsg := Message{
+				Type:    "private",
+				Content: fmt.Sprintf("(to %s): %s", pMsg.TargetUser, pMsg.Message.Content),
+			}
+			h.sendToClient(pMsg.Sender, senderConfirmMsg)
+		} else {
+			h.replyToPrivateMessage(pMsg, "")
+		}
+		return
+	}
+
+	// Check remote users
+	serverAddr, _, ok := h.bestRoute(pMsg.TargetUser)
+	if pMsg.TargetServer != "" {
+		serverAddr, _, ok = h.routeVia(pMsg.TargetUser, pMsg.TargetServer)
+	}
+	var server *ServerConnection
+	if ok && pMsg.Hops < federationMaxHops {
+		server = h.federation.serverByAddr(serverAddr)
+	}
+	if server == nil {
+		if pMsg.Sender != nil {
+			h.sendToClient(pMsg.Sender, Message{Type: "system", Content: fmt.Sprintf("User '%s' not found.", privateTarget(pMsg))})
+			return
+		}
+		h.replyToPrivateMessage(pMsg, "user not found")
+		return
+	}
+
+	if pMsg.ID == "" && pMsg.Sender != nil {
+		pMsg.ID = newMessageID()
+	}
+	fromServer := pMsg.Message.Server
+	if fromServer == "" {
+		fromServer = h.selfName()
+	}
+	err := server.sendPrivateMessage(PrivateMessagePayload{
+		From:         pMsg.Message.Author,
+		FromServer:   fromServer,
+		FromAuthed:   pMsg.Message.AuthorIsAuthed,
+		FromProvider: pMsg.Message.AuthProvider,
+		To:           pMsg.TargetUser,
+		ToServer:     pMsg.TargetServer,
+		Text:         pMsg.Message.Content,
+		Hops:         pMsg.Hops + 1,
+		ID:           pMsg.ID,
+	})
+	if err != nil {
+		h.failPrivateMessage(pMsg, err.Error())
+		return
+	}
+
+	if pMsg.Sender == nil {
+		return
+	}
+	if !server.supports("private_message_ack") {
+		h.sendToClient(pMsg.Sender, Message{Type: "private", Content: fmt.Sprintf("(to %s, unconfirmed): %s", privateTarget(pMsg), pMsg.Message.Content)})
+		return
+	}
+	h.pendingPrivate[pMsg.ID] = pendingPrivateMessage{sender: pMsg.Sender, recipient: privateTarget(pMsg), content: pMsg.Message.Content}
+	id := pMsg.ID
+	time.AfterFunc(privateMessageAckTimeout, func() { h.privateTimeouts <- id })
+}
+
+// failPrivateMessage reports a DM that could not be delivered to its sender,
+// locally or with a private_message_error.
+func (h *Hub) failPrivateMessage(pMsg privateMessagePayload, reason string) {
+	if pMsg.Sender != nil {
+		h.sendToClient(pMsg.Sender, SystemMessage(fmt.Sprintf("Message to %s was not delivered: %s.", privateTarget(pMsg), reason)))
+		return
+	}
+	h.replyToPrivateMessage(pMsg, reason)
+}
+
+// replyToPrivateMessage sends the receipt for a DM that came from another
+// server. DMs without an ID come from servers that do not expect one.
+func (h *Hub) replyToPrivateMessage(pMsg privateMessagePayload, reason string) {
+	if pMsg.ID == "" {
+		return
+	}
+	h.handlePrivateReceipt(PrivateMessageReceiptPayload{
+		ID:        pMsg.ID,
+		To:        normalizeUsername(pMsg.Message.Author),
+		ToServer:  pMsg.Message.Server,
+		Recipient: privateTarget(pMsg),
+		Error:     reason,
+	})
+}
+
+// handlePrivateReceipt shows a receipt to its local sender or forwards it
+// towards the sender's home server.
+func (h *Hub) handlePrivateReceipt(receipt PrivateMessageReceiptPayload) {
+	if pending, ok := h.pendingPrivate[receipt.ID]; ok && (receipt.ToServer == "" || receipt.ToServer == h.selfName()) {
+		delete(h.pendingPrivate, receipt.ID)
+		if _, connected := h.clients[pending.sender]; !connected {
+			return
+		}
+		if receipt.Error != "" {
+			h.sendToClient(pending.sender, SystemMessage(fmt.Sprintf("Message to %s was not delivered: %s.", pending.recipient, receipt.Error)))
+			return
+		}
+		h.sendToClient(pending.sender, Message{Type: "private", Content: fmt.Sprintf("(to %s, delivered): %s", pending.recipient, pending.content)})
+		return
+	}
+
+	serverAddr, _, ok := h.bestRoute(receipt.To)
+	if receipt.ToServer != "" {
+		serverAddr, _, ok = h.routeVia(receipt.To, receipt.ToServer)
+	}
+	if !ok || receipt.Hops >= federationMaxHops {
+		log.Printf("Dropping private message receipt %s for %s@%s: no route", receipt.ID, receipt.To, receipt.ToServer)
+		return
+	}
+	if server := h.federation.serverByAddr(serverAddr); server != nil {
+		receipt.Hops++
+		server.sendPrivateReceipt(receipt)
+	}
+}
+
+// expirePrivateMessage tells the sender when no receipt arrived in time.
+func (h *Hub) expirePrivateMessage(id string) {
+	pending, ok := h.pendingPrivate[id]
+	if !ok {
+		return
+	}
+	delete(h.pendingPrivate, id)
+	if _, connected := h.clients[pending.sender]; connected {
+		h.sendToClient(pending.sender, SystemMessage(fmt.Sprintf("No delivery confirmation for your message to %s.", pending.recipient)))
+	}
+}
+
+func (sc *ServerConnection) sendPrivateReceipt(receipt PrivateMessageReceiptPayload) {
+	if !sc.isAuthenticated() || !sc.supports("private_message_ack") {
+		return
+	}
+
+	stdin := sc.getConnectionWriter()
+	if stdin == nil {
+		return
+	}
+
+	b, err := json.Marshal(receipt)
+	if err != nil {
+		log.Printf("Failed to marshal private message receipt: %v", err)
+		return
+	}
+
+	msgType := "private_message_ack"
+	if receipt.Error != "" {
+		msgType = "private_message_error"
+	}
+	if err := sc.queueMessage(stdin, FederationMessage{Type: msgType, Payload: b}); err != nil {
+		log.Printf("Failed to send %s to %s: %v", msgType, sc.addr, err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFederatedPrivateMessageReceipts(t *testing.T) {
+	h := newHub()
+	h.federation = &Federation{hub: h, serverID: "B", serverName: "beta", nonces: newNonceCache(federationNonceTTL)}
+	peer := NewServerConnection("a:22", h, "", "secret")
+	out := &bytes.Buffer{}
+	peer.setConnection(out)
+	peer.setAuthenticated(true)
+	peer.peer = &peerInfo{ServerID: "A", ServerName: "alpha", Capabilities: map[string]bool{"private_message": true, "private_message_ack": true}}
+	h.federation.servers = append(h.federation.servers, peer)
+	h.setRoute("a:22", "bob", nickRoute{Path: []string{"A"}})
+
+	alice := &Client{user: "alice", send: make(chan Message, 10)}
+	h.clients[alice] = true
+	h.clientsByName["alice"] = alice
+
+	h.handlePrivateMessage(privateMessagePayload{TargetUser: "bob", Message: Message{Author: "alice", Content: "hi"}, Sender: alice})
+	frame, err := readFrame(out)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	var msg FederationMessage
+	var sent PrivateMessagePayload
+	if err := json.Unmarshal(frame, &msg); err != nil || json.Unmarshal(msg.Payload, &sent) != nil {
+		t.Fatalf("unexpected frame %q", frame)
+	}
+	if sent.ID == "" || sent.FromServer != "beta" || len(h.pendingPrivate) != 1 {
+		t.Fatalf("DM should carry an ID and wait for a receipt: %+v", sent)
+	}
+
+	h.handlePrivateReceipt(PrivateMessageReceiptPayload{ID: sent.ID, To: "alice", ToServer: "beta", Recipient: "bob"})
+	if got := (<-alice.send).Content; got != "(to bob, delivered): hi" {
+		t.Fatalf("sender saw %q after the ack", got)
+	}
+	if len(h.pendingPrivate) != 0 {
+		t.Fatal("an acknowledged DM should no longer be pending")
+	}
+
+	// A DM from another server to a user who is not here is answered with an error.
+	h.handlePrivateMessage(privateMessagePayload{TargetUser: "nobody", Message: Message{Author: "bob", Server: "alpha", Content: "yo"}, ID: "dm-2", Hops: 1})
+	frame, err = readFrame(out)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if !strings.Contains(string(frame), `"type":"private_message_error"`) || !strings.Contains(string(frame), "user not found") {
+		t.Fatalf("expected a private_message_error, got %q", frame)
+	}
+
+	h.pendingPrivate["dm-3"] = pendingPrivateMessage{sender: alice, recipient: "bob", content: "hello?"}
+	h.handlePrivateReceipt(PrivateMessageReceiptPayload{ID: "dm-3", To: "alice", ToServer: "beta", Error: "user not found"})
+	if got := (<-alice.send).Content; !strings.Contains(got, "not delivered: user not found") {
+		t.Fatalf("sender saw %q after the error", got)
+	}
+
+	h.pendingPrivate["dm-4"] = pendingPrivateMessage{sender: alice, recipient: "bob", content: "anyone?"}
+	h.expirePrivateMessage("dm-4")
+	if got := (<-alice.send).Content; !strings.Contains(got, "No delivery confirmation") {
+		t.Fatalf("sender saw %q after the timeout", got)
+	}
+}
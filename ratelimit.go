@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every line a user enters is checked against a token bucket for its kind
+// before it reaches the hub. A bucket holds up to burst tokens and regains
+// one per interval, so short bursts pass while a sustained flood is dropped.
+// Users who keep hitting the limit are muted for a while.
+
+const (
+	limitMessage    = "message"
+	limitCommand    = "command"
+	limitPrivate    = "private"
+	limitNameChange = "name_change"
+)
+
+const (
+	defaultMessageInterval    = time.Second
+	defaultMessageBurst       = 5
+	defaultCommandInterval    = 500 * time.Millisecond
+	defaultCommandBurst       = 10
+	defaultPrivateInterval    = time.Second
+	defaultPrivateBurst       = 5
+	defaultNameChangeInterval = 10 * time.Second
+	defaultNameChangeBurst    = 3
+	defaultFloodMuteAfter     = 10
+	defaultFloodMuteWindow    = time.Minute
+	defaultFloodMuteDuration  = 5 * time.Minute
+)
+
+// floodIssuer is the issuer shown on automatic mutes.
+const floodIssuer = "flood protection"
+
+type LimitsConfig struct {
+	MessageInterval    time.Duration `ini:"message_interval"`
+	MessageBurst       int           `ini:"message_burst"`
+	CommandInterval    time.Duration `ini:"command_interval"`
+	CommandBurst       int           `ini:"command_burst"`
+	PrivateInterval    time.Duration `ini:"private_interval"`
+	PrivateBurst       int           `ini:"private_burst"`
+	NameChangeInterval time.Duration `ini:"name_change_interval"`
+	NameChangeBurst    int           `ini:"name_change_burst"`
+	MuteAfter          int           `ini:"mute_after"` // Dropped lines within MuteWindow that trigger a mute, 0 to never mute
+	MuteWindow         time.Duration `ini:"mute_window"`
+	MuteDuration       time.Duration `ini:"mute_duration"`
+}
+
+// bucket returns the refill interval and burst for a kind of input.
+func (lc LimitsConfig) bucket(kind string) (time.Duration, int) {
+	switch kind {
+	case limitMessage:
+		return lc.MessageInterval, lc.MessageBurst
+	case limitPrivate:
+		return lc.PrivateInterval, lc.PrivateBurst
+	case limitNameChange:
+		return lc.NameChangeInterval, lc.NameChangeBurst
+	default:
+		return lc.CommandInterval, lc.CommandBurst
+	}
+}
+
+func (lc LimitsConfig) validate() error {
+	for _, kind := range []string{limitMessage, limitCommand, limitPrivate, limitNameChange} {
+		interval, burst := lc.bucket(kind)
+		if interval < 0 {
+			return fmt.Errorf("`%s_interval` in section `limits` cannot be negative", kind)
+		}
+		if interval > 0 && burst < 1 {
+			return fmt.Errorf("`%s_burst` in section `limits` must be at least 1", kind)
+		}
+	}
+	if lc.MuteAfter < 0 {
+		return fmt.Errorf("`mute_after` in section `limits` cannot be negative")
+	}
+	if lc.MuteAfter > 0 && (lc.MuteWindow <= 0 || lc.MuteDuration <= 0) {
+		return fmt.Errorf("`mute_window` and `mute_duration` in section `limits` must be set when `mute_after` is")
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds one client's buckets and recent dropped lines.
+type rateLimiter struct {
+	mu      sync.Mutex
+	cfg     LimitsConfig
+	buckets map[string]*tokenBucket
+	strikes []time.Time
+}
+
+func newRateLimiter(cfg LimitsConfig) *rateLimiter {
+	return &rateLimiter{cfg: cfg, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token for kind. When none is left it records a strike and
+// reports whether the user has now earned a flood mute.
+func (l *rateLimiter) allow(kind string, now time.Time) (allowed, mute bool) {
+	interval, burst := l.cfg.bucket(kind)
+	if interval <= 0 {
+		return true, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[kind]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[kind] = b
+	}
+	b.tokens = min(float64(burst), b.tokens+float64(now.Sub(b.last))/float64(interval))
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, false
+	}
+
+	if l.cfg.MuteAfter == 0 {
+		return false, false
+	}
+	kept := l.strikes[:0]
+	for _, strike := range l.strikes {
+		if now.Sub(strike) < l.cfg.MuteWindow {
+			kept = append(kept, strike)
+		}
+	}
+	l.strikes = append(kept, now)
+	if len(l.strikes) >= l.cfg.MuteAfter {
+		l.strikes = nil
+		return false, true
+	}
+	return false, false
+}
+
+// inputKind tells which bucket a line typed by the user is charged to.
+func inputKind(input string) string {
+	if !strings.HasPrefix(input, "/") {
+		return limitMessage
+	}
+	command, _, _ := strings.Cut(input, " ")
+	switch command {
+	case "/w":
+		return limitPrivate
+	case "/n", "/gh":
+		return limitNameChange
+	default:
+		return limitCommand
+	}
+}
+
+// allowInput checks a line typed by c against its rate limits. A dropped
+// line comes with a notice for the user; a line that earns a flood mute has
+// none, as the hub tells the user about the mute.
+func (c *Client) allowInput(input string) (bool, string) {
+	if c.limiter == nil {
+		return true, ""
+	}
+	kind := inputKind(input)
+	allowed, mute := c.limiter.allow(kind, time.Now())
+	if mute {
+		c.hub.floodMute(c, c.limiter.cfg.MuteDuration)
+		return false, ""
+	}
+	if !allowed {
+		return false, fmt.Sprintf("You are sending too fast; %s not sent.", kindNames[kind])
+	}
+	return true, ""
+}
+
+var kindNames = map[string]string{
+	limitMessage:    "message",
+	limitCommand:    "command",
+	limitPrivate:    "private message",
+	limitNameChange: "name change",
+}
+
+type floodMuteRequest struct {
+	client   *Client
+	duration time.Duration
+}
+
+func (h *Hub) floodMute(c *Client, duration time.Duration) {
+	h.floodMutes <- floodMuteRequest{client: c, duration: duration}
+}
+
+// muteFlooder mutes a user who kept hitting their rate limits. The mute
+// stays on this server; moderators and admins are never muted this way. A
+// user with neither a proven login nor a key is muted for this session only,
+// as their address may be shared by everyone behind the same NAT.
+func (h *Hub) muteFlooder(req floodMuteRequest) {
+	c := req.client
+	if !h.clients[c] || roleRank(c.Role()) > 0 {
+		return
+	}
+	action := moderationAction{
+		ID:          newMessageID(),
+		Action:      moderationMute,
+		Issuer:      floodIssuer,
+		Fingerprint: c.KeyFingerprint(),
+		Reason:      "flooding",
+		Expires:     time.Now().Add(req.duration),
+	}
+	if c.IsAuthed() {
+		action.Login = c.User()
+	}
+	if action.Login == "" && action.Fingerprint == "" {
+		action.session = c
+	}
+	h.applyModeration(action)
+}
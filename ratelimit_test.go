@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBucket(t *testing.T) {
+	l := newRateLimiter(LimitsConfig{MessageInterval: time.Second, MessageBurst: 3, MuteAfter: 3, MuteWindow: time.Minute})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.allow(limitMessage, now); !allowed {
+			t.Fatalf("message %d within the burst was dropped", i+1)
+		}
+	}
+	if allowed, mute := l.allow(limitMessage, now); allowed || mute {
+		t.Fatalf("message over the burst = (%v, %v), want dropped without a mute", allowed, mute)
+	}
+	if allowed, _ := l.allow(limitCommand, now); !allowed {
+		t.Fatal("commands should have their own bucket")
+	}
+
+	now = now.Add(1500 * time.Millisecond)
+	if allowed, _ := l.allow(limitMessage, now); !allowed {
+		t.Fatal("a token should be back after one interval")
+	}
+	if allowed, mute := l.allow(limitMessage, now); allowed || mute {
+		t.Fatal("only one token should have been regained")
+	}
+	if allowed, mute := l.allow(limitMessage, now); allowed || !mute {
+		t.Fatalf("third dropped message = (%v, %v), want a mute", allowed, mute)
+	}
+	if _, mute := l.allow(limitMessage, now); mute {
+		t.Fatal("strikes should start over after a mute")
+	}
+
+	unlimited := newRateLimiter(LimitsConfig{})
+	for i := 0; i < 100; i++ {
+		if allowed, _ := unlimited.allow(limitMessage, now); !allowed {
+			t.Fatal("an interval of 0 should turn the limit off")
+		}
+	}
+}
+
+func TestInputKind(t *testing.T) {
+	for input, want := range map[string]string{
+		"hello":       limitMessage,
+		"/w bob hi":   limitPrivate,
+		"/n newname":  limitNameChange,
+		"/gh":         limitNameChange,
+		"/u":          limitCommand,
+		"/without-me": limitCommand,
+	} {
+		if got := inputKind(input); got != want {
+			t.Fatalf("inputKind(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestLimitsValidate(t *testing.T) {
+	if err := (LimitsConfig{MessageInterval: time.Second}).validate(); err == nil {
+		t.Fatal("a limit without a burst should be rejected")
+	}
+	if err := (LimitsConfig{MuteAfter: 5}).validate(); err == nil {
+		t.Fatal("mute_after without a window and duration should be rejected")
+	}
+	if err := (LimitsConfig{}).validate(); err != nil {
+		t.Fatalf("no limits at all should be valid: %v", err)
+	}
+}
+
+func TestFloodMute(t *testing.T) {
+	h := newHub()
+	f, err := NewFederation(h, FederationConfig{}, nil)
+	if err != nil {
+		t.Fatalf("NewFederation error: %v", err)
+	}
+	h.federation = f
+	go h.run()
+	flooder := &Client{hub: h, user: "flooder", send: make(chan Message, 10), addr: netip.MustParseAddr("198.51.100.9")}
+	flooder.limiter = newRateLimiter(LimitsConfig{MessageInterval: time.Hour, MessageBurst: 1, MuteAfter: 2, MuteWindow: time.Minute, MuteDuration: time.Minute})
+	h.register <- flooder
+	<-flooder.send // join notice
+
+	if allowed, _ := flooder.allowInput("first"); !allowed {
+		t.Fatal("the first message should pass")
+	}
+	if allowed, notice := flooder.allowInput("second"); allowed || !strings.Contains(notice, "too fast") {
+		t.Fatalf("second message = (%v, %q), want dropped with a notice", allowed, notice)
+	}
+	if allowed, notice := flooder.allowInput("third"); allowed || notice != "" {
+		t.Fatalf("third message = (%v, %q), want dropped for the hub to mute", allowed, notice)
+	}
+	msg := <-flooder.send
+	if !strings.HasPrefix(msg.Content, "You have been muted by flood protection until") || !strings.HasSuffix(msg.Content, ": flooding.") {
+		t.Fatalf("flooder got %q, want a flood mute notice", msg.Content)
+	}
+
+	// The flooder had no login or key: the mute holds their session, not
+	// everyone else at the same address.
+	neighbour := &Client{hub: h, user: "neighbour", send: make(chan Message, 10), addr: flooder.addr}
+	h.register <- neighbour
+	<-neighbour.send // join notice
+	<-flooder.send   // neighbour's join notice
+	h.broadcast <- Message{Author: "flooder", Content: "spam", Type: "public", Room: defaultRoom}
+	if msg := <-flooder.send; !strings.HasSuffix(msg.Content, "Your message was not sent.") {
+		t.Fatalf("flooder got %q, want their message refused", msg.Content)
+	}
+	h.broadcast <- Message{Author: "neighbour", Content: "hello", Type: "public", Room: defaultRoom}
+	if msg := <-neighbour.send; msg.Content != "hello" {
+		t.Fatalf("neighbour got %q, want their message delivered", msg.Content)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Federated servers do not need a full mesh. Every server advertises to each
+// peer the users it can reach, each with the path of server IDs leading to
+// the user's home server. The hub keeps the routes learned from every direct
+// peer and forwards DMs along the shortest one. Routes are never advertised
+// back to the peer they came from, never to a server already on the path, and
+// never beyond federationMaxHops, which keeps the tables loop-free.
+
+const (
+	federationMaxHops = 8
+	seenMessageTTL    = 10 * time.Minute
+)
+
+// nickRoute describes how a remote nick is reached through one direct peer.
+type nickRoute struct {
+	Path     []string // Server IDs, starting with the direct peer
+	Server   string   // Name of the user's home server
+	Clock    uint64   // Lamport timestamp of the home server's claim on the nick
+	Authed   bool     // The nick was claimed through GitHub auth
+	Provider string   // Provider that verified the user, "" if anonymous
+}
+
+// sameRoute reports whether two advertisements of a nick are identical.
+func sameRoute(a, b nickRoute) bool {
+	return pathKey(a.Path) == pathKey(b.Path) && a.Server == b.Server && a.Clock == b.Clock && a.Authed == b.Authed && a.Provider == b.Provider
+}
+
+// preferRoute reports whether route a to a nick should be used over route b.
+// Routes to different home servers are ranked by their claims, so every
+// server agrees on who owns a contested nick; otherwise the shorter path wins
+// and ties go to the lowest address.
+func preferRoute(a nickRoute, aAddr string, b nickRoute, bAddr string) bool {
+	if a.home() != b.home() {
+		return a.claim().beats(b.claim())
+	}
+	if a.hops() != b.hops() {
+		return a.hops() < b.hops()
+	}
+	return aAddr < bAddr
+}
+
+func (r nickRoute) hops() int {
+	return len(r.Path)
+}
+
+// home returns the ID of the server the user is connected to.
+func (r nickRoute) home() string {
+	if len(r.Path) == 0 {
+		return ""
+	}
+	return r.Path[len(r.Path)-1]
+}
+
+func pathKey(path []string) string {
+	return strings.Join(path, ",")
+}
+
+func (h *Hub) selfID() string {
+	if h.federation == nil {
+		return ""
+	}
+	return h.federation.serverID
+}
+
+func (h *Hub) selfName() string {
+	if h.federation == nil {
+		return ""
+	}
+	return h.federation.serverName
+}
+
+// directPath is the path used for nicks a peer reports without one.
+func (h *Hub) directPath(serverAddr string) []string {
+	if h.federation != nil {
+		if sc := h.federation.serverByAddr(serverAddr); sc != nil {
+			return []string{sc.peerID()}
+		}
+	}
+	return []string{""}
+}
+
+// homeName names the home server at the end of path for peers that do not
+// send server names: the direct peer's own name, or else the home server ID.
+func (h *Hub) homeName(serverAddr string, path []string) string {
+	if len(path) > 1 {
+		return path[len(path)-1]
+	}
+	if h.federation != nil {
+		if sc := h.federation.serverByAddr(serverAddr); sc != nil {
+			return sc.peerName()
+		}
+	}
+	return serverAddr
+}
+
+// setRoute stores a route learned from serverAddr. Routes whose path already
+// contains this server are loops and are dropped.
+func (h *Hub) setRoute(serverAddr, nick string, route nickRoute) {
+	if len(route.Path) == 0 {
+		route.Path = h.directPath(serverAddr)
+	}
+	if route.Server == "" {
+		route.Server = h.homeName(serverAddr, route.Path)
+	}
+	h.observeClock(route.Clock)
+	routes, ok := h.remoteNicks[serverAddr]
+	if !ok {
+		routes = make(map[string]nickRoute)
+		h.remoteNicks[serverAddr] = routes
+	}
+
+	if self := h.selfID(); self != "" && slices.Contains(route.Path, self) {
+		delete(routes, nick)
+		return
+	}
+	routes[nick] = route
+}
+
+// warnOnDuplicateNick logs when nick is reported by two different home servers.
+// Several routes to the same home server are expected and not reported.
+func (h *Hub) warnOnDuplicateNick(serverAddr, nick string, path []string) {
+	if len(path) == 0 {
+		path = h.directPath(serverAddr)
+	}
+	currentServer, existing, ok := h.bestRoute(nick)
+	if ok && existing.home() != (nickRoute{Path: path}).home() {
+		log.Printf("Warning: User %s exists on multiple servers (via %s and %s)", nick, currentServer, serverAddr)
+	}
+}
+
+// bestRoute returns the direct peer on the preferred route to nick.
+func (h *Hub) bestRoute(nick string) (string, nickRoute, bool) {
+	nick = normalizeUsername(nick)
+	bestAddr := ""
+	var best nickRoute
+	found := false
+	for serverAddr, routes := range h.remoteNicks {
+		route, ok := routes[nick]
+		if !ok {
+			continue
+		}
+		if !found || preferRoute(route, serverAddr, best, bestAddr) {
+			bestAddr, best, found = serverAddr, route, true
+		}
+	}
+	return bestAddr, best, found
+}
+
+// routeVia is bestRoute restricted to routes ending at the named server. It
+// lets nick@server reach the right user while a bare nick is ambiguous.
+func (h *Hub) routeVia(nick, server string) (string, nickRoute, bool) {
+	nick = normalizeUsername(nick)
+	bestAddr := ""
+	var best nickRoute
+	found := false
+	for serverAddr, routes := range h.remoteNicks {
+		route, ok := routes[nick]
+		if !ok || route.Server != server {
+			continue
+		}
+		if !found || preferRoute(route, serverAddr, best, bestAddr) {
+			bestAddr, best, found = serverAddr, route, true
+		}
+	}
+	return bestAddr, best, found
+}
+
+// serverOfNick returns the home server name of a remote nick, or our own
+// name for a local one.
+func (h *Hub) serverOfNick(nick string) string {
+	if _, local := h.clientsByName[nick]; local {
+		return h.selfName()
+	}
+	_, route, _ := h.bestRoute(nick)
+	return route.Server
+}
+
+// remoteNickNames lists the nicks reachable through serverAddr.
+func (h *Hub) remoteNickNames(serverAddr string) []string {
+	names := make([]string, 0, len(h.remoteNicks[serverAddr]))
+	for nick := range h.remoteNicks[serverAddr] {
+		names = append(names, nick)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// allRemoteNicks lists every reachable remote nick once.
+func (h *Hub) allRemoteNicks() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, routes := range h.remoteNicks {
+		for nick := range routes {
+			if !seen[nick] {
+				seen[nick] = true
+				names = append(names, nick)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// remoteUserLabels lists every reachable remote user for /u, marking
+// anonymous ones. With server names shown, a nick on two servers, as after a
+// netsplit, is listed once per server as nick@server.
+func (h *Hub) remoteUserLabels() []string {
+	seen := make(map[string]bool)
+	var labels []string
+	for _, routes := range h.remoteNicks {
+		for nick, route := range routes {
+			if !h.showServerNames {
+				_, route, _ = h.bestRoute(nick)
+			}
+			label := userLabel(h.displayName(nick, route.Server), route.Authed)
+			if !seen[label] {
+				seen[label] = true
+				labels = append(labels, label)
+			}
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// userLabel marks anonymous users the way the chat view does.
+func userLabel(name string, authed bool) string {
+	if authed {
+		return name
+	}
+	return "[anon] " + name
+}
+
+// displayName formats nick as nick@server when server names are shown.
+func (h *Hub) displayName(nick, server string) string {
+	if !h.showServerNames || server == "" {
+		return nick
+	}
+	return nick + "@" + server
+}
+
+// advertisementFor returns the nicks and routes we offer to conn.
+func (h *Hub) advertisementFor(conn *ServerConnection) map[string]nickRoute {
+	self := h.selfID()
+	selfName := h.selfName()
+	peerID := conn.peerID()
+
+	adv := make(map[string]nickRoute)
+	for client := range h.clients {
+		adv[client.User()] = nickRoute{Path: []string{self}, Server: selfName, Clock: client.NickClock(), Authed: client.IsAuthed(), Provider: client.AuthProvider()}
+	}
+
+	for _, nick := range h.allRemoteNicks() {
+		if _, local := adv[nick]; local {
+			continue
+		}
+		addr, route, ok := h.bestRoute(nick)
+		if !ok || addr == conn.addr {
+			continue
+		}
+		if route.hops()+1 > federationMaxHops {
+			continue
+		}
+		if peerID != "" && slices.Contains(route.Path, peerID) {
+			continue
+		}
+		route.Path = append([]string{self}, route.Path...)
+		adv[nick] = route
+	}
+	return adv
+}
+
+// sendNickSnapshot sends conn a full snapshot, or a checksum when full is
+// false and the peer understands deltas.
+func (h *Hub) sendNickSnapshot(conn *ServerConnection, full bool) {
+	adv := h.advertisementFor(conn)
+	names := make([]string, 0, len(adv))
+	for nick := range adv {
+		names = append(names, nick)
+	}
+
+	if !full && conn.supports("user_delta") {
+		conn.sendNickChecksum(names)
+		return
+	}
+
+	conn.sendNickSync(names, adv)
+	if conn.isAuthenticated() {
+		h.advertised[conn.addr] = adv
+	}
+}
+
+// syncAdvertisements sends every peer the user_join/user_leave deltas needed
+// to bring it in line with our current routes. Peers that have not had a
+// snapshot yet are skipped; they get one as soon as their hello arrives.
+func (h *Hub) syncAdvertisements() {
+	if h.federation == nil {
+		return
+	}
+
+	for _, conn := range h.federation.Peers() {
+		previous, ok := h.advertised[conn.addr]
+		if !ok {
+			continue
+		}
+		if !conn.isAuthenticated() {
+			delete(h.advertised, conn.addr)
+			continue
+		}
+		if !conn.supports("user_delta") {
+			continue
+		}
+
+		current := h.advertisementFor(conn)
+		for nick := range previous {
+			if _, still := current[nick]; !still {
+				conn.sendUserDelta("user_leave", nick, nickRoute{})
+			}
+		}
+		for nick, route := range current {
+			if old, had := previous[nick]; !had || !sameRoute(old, route) {
+				conn.sendUserDelta("user_join", nick, route)
+			}
+		}
+		h.advertised[conn.addr] = current
+	}
+}
+
+// markSeen records the ID of a flooded message and reports whether it is new.
+func (h *Hub) markSeen(id string) bool {
+	return id == "" || h.seenMessages.add(id)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRoutingAdvertisementAndLoopPrevention(t *testing.T) {
+	h := newHub()
+	f := &Federation{hub: h, serverID: "B", nonces: newNonceCache(federationNonceTTL)}
+	h.federation = f
+
+	peerA := NewServerConnection("a:22", h, "", "secret")
+	peerC := NewServerConnection("c:22", h, "", "secret")
+	for _, sc := range []*ServerConnection{peerA, peerC} {
+		sc.setConnection(&bytes.Buffer{})
+		sc.setAuthenticated(true)
+		f.servers = append(f.servers, sc)
+	}
+	peerA.peer = &peerInfo{ServerID: "A", Capabilities: map[string]bool{"user_delta": true}}
+	peerC.peer = &peerInfo{ServerID: "C", Capabilities: map[string]bool{"user_delta": true}}
+
+	local := &Client{user: "bob", send: make(chan Message, 10)}
+	h.clients[local] = true
+	h.clientsByName["bob"] = local
+
+	h.setRoute("a:22", "alice", nickRoute{Path: []string{"A"}})
+	h.setRoute("c:22", "alice", nickRoute{Path: []string{"C", "A"}})
+	h.setRoute("c:22", "loop", nickRoute{Path: []string{"C", "B", "A"}})
+
+	if _, ok := h.remoteNicks["c:22"]["loop"]; ok {
+		t.Fatal("routes that pass through this server should be dropped")
+	}
+	if addr, ok := h.findServerForNick("alice"); !ok || addr != "a:22" {
+		t.Fatalf("findServerForNick(alice) = (%q, %v), want a:22", addr, ok)
+	}
+
+	toC := h.advertisementFor(peerC)
+	if got := pathKey(toC["alice"].Path); got != "B,A" {
+		t.Fatalf("alice advertised to C with path %q, want B,A", got)
+	}
+	if got := pathKey(toC["bob"].Path); got != "B" {
+		t.Fatalf("local user advertised with path %q, want B", got)
+	}
+
+	toA := h.advertisementFor(peerA)
+	if _, ok := toA["alice"]; ok {
+		t.Fatal("a route must not be advertised back to the peer it was learned from")
+	}
+
+	h.setRoute("c:22", "carol", nickRoute{Path: []string{"C", "A", "D"}})
+	toA = h.advertisementFor(peerA)
+	if _, ok := toA["carol"]; ok {
+		t.Fatal("a route must not be advertised to a server already on its path")
+	}
+
+	if users := h.allRemoteNicks(); len(users) != 2 {
+		t.Fatalf("allRemoteNicks() = %v, want alice and carol once each", users)
+	}
+
+	if !h.markSeen("msg-1") || h.markSeen("msg-1") {
+		t.Fatal("markSeen should accept an ID once")
+	}
+}
+
+func TestUserAtServerAddressing(t *testing.T) {
+	h := newHub()
+	h.federation = &Federation{hub: h, serverID: "B", serverName: "beta", nonces: newNonceCache(federationNonceTTL)}
+	peerA := NewServerConnection("a:22", h, "", "secret")
+	peerA.peer = &peerInfo{ServerID: "A", ServerName: "alpha"}
+	h.federation.servers = append(h.federation.servers, peerA)
+
+	// Two different users called alice, as after a netsplit heals.
+	h.setRoute("a:22", "alice", nickRoute{Path: []string{"A"}})
+	h.setRoute("c:22", "alice", nickRoute{Path: []string{"C", "D"}, Server: "delta"})
+
+	if addr, route, ok := h.routeVia("alice", "delta"); !ok || addr != "c:22" || route.home() != "D" {
+		t.Fatalf("routeVia(alice, delta) = (%q, %v, %v), want c:22", addr, route, ok)
+	}
+	if addr, _, ok := h.routeVia("alice", "alpha"); !ok || addr != "a:22" {
+		t.Fatalf("routeVia(alice, alpha) = (%q, %v), want a:22 named after the peer's hello", addr, ok)
+	}
+	if _, _, ok := h.routeVia("alice", "beta"); ok {
+		t.Fatal("routeVia should not find a remote route to our own server")
+	}
+
+	h.showServerNames = true
+	if got := h.remoteUserLabels(); len(got) != 2 || got[0] != "[anon] alice@alpha" || got[1] != "[anon] alice@delta" {
+		t.Fatalf("remoteUserLabels() = %v, want alice@alpha and alice@delta", got)
+	}
+
+	adv := h.advertisementFor(NewServerConnection("e:22", h, "", "secret"))
+	if adv["alice"].Server != "alpha" {
+		t.Fatalf("advertised alice on %q, want the home server name alpha", adv["alice"].Server)
+	}
+}
@@ -82,6 +82,15 @@ func (m tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 			m.textarea.Reset()
 
+			if allowed, notice := m.client.allowInput(input); !allowed {
+				if notice != "" {
+					return m, func() tea.Msg {
+						return incomingMessageMsg(SystemMessage(notice))
+					}
+				}
+				return m, nil
+			}
+
 			responseMsg, isCmd := handleCommand(m.client, input, m.config)
 			if isCmd {
 				if responseMsg.Content != "" {
@@ -92,11 +101,19 @@ func (m tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, nil
 			}
 
+			if refusal := anonymousRefusal(m.client, m.config.anonymousPolicy(), ""); refusal != "" {
+				return m, func() tea.Msg {
+					return incomingMessageMsg(SystemMessage(refusal))
+				}
+			}
+
 			m.client.hub.broadcast <- Message{
 				Author:         m.client.User(),
 				Content:        input,
 				Type:           "public",
 				AuthorIsAuthed: m.client.IsAuthed(),
+				AuthProvider:   m.client.AuthProvider(),
+				Room:           m.client.Room(),
 			}
 			return m, nil
 		}
@@ -114,6 +131,9 @@ func (m tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "public":
 			fallthrough
 		default:
+			if msg.Server != "" && m.config != nil && m.config.Chat.ShowServerNames {
+				safeAuthor += "@" + sanitizeForTerminal(msg.Server)
+			}
 			var author string
 			if msg.AuthorIsAuthed {
 				author = m.senderStyle.Render(safeAuthor)
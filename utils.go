@@ -3,6 +3,7 @@ package main
 import (
 	cryptorand "crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"regexp"
 	"strings"
@@ -23,6 +24,15 @@ func generateAnonymousName() string {
 	return fmt.Sprintf("Anonymous%04d", int(binary.BigEndian.Uint16(b[:]))%10000)
 }
 
+// newMessageID returns a random ID for messages flooded through the federation.
+func newMessageID() string {
+	var b [16]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
 func normalizeUsername(name string) string {
 	return norm.NFC.String(strings.TrimSpace(name))
 }
@@ -47,6 +57,67 @@ func isValidUsername(name string) bool {
 	return true
 }
 
+// normalizeRoomName lowercases a room name and adds the leading '#'.
+func normalizeRoomName(name string) string {
+	name = strings.ToLower(normalizeUsername(name))
+	if !strings.HasPrefix(name, "#") {
+		name = "#" + name
+	}
+	return name
+}
+
+// normalizeServerName lowercases a federation server name.
+func normalizeServerName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// isValidServerName accepts 1-32 ASCII letters, digits, '-' and '.', so names
+// read well after an '@' and cannot be confused with a nick.
+func isValidServerName(name string) bool {
+	normalized := normalizeServerName(name)
+	if len(normalized) < 1 || len(normalized) > 32 {
+		return false
+	}
+	for _, r := range normalized {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// splitUserAddress splits "nick@server" into its parts. The server is empty
+// for a bare nick.
+func splitUserAddress(address string) (string, string) {
+	nick, server, found := strings.Cut(address, "@")
+	if !found {
+		return normalizeUsername(address), ""
+	}
+	return normalizeUsername(nick), normalizeServerName(server)
+}
+
+func isValidRoomName(name string) bool {
+	normalized := normalizeRoomName(name)
+	body := strings.TrimPrefix(normalized, "#")
+	runeCount := utf8.RuneCountInString(body)
+	if runeCount < 2 || runeCount > 20 {
+		return false
+	}
+
+	for _, r := range body {
+		if r == '_' || r == '-' {
+			continue
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) {
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
 func sanitizeForTerminal(input string) string {
 	cleaned := ansiEscapePattern.ReplaceAllString(input, "")
 
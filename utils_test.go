@@ -43,6 +43,18 @@ func TestIsValidUsername(t *testing.T) {
 	}
 }
 
+func TestRoomNames(t *testing.T) {
+	if got := normalizeRoomName(" Ops "); got != "#ops" {
+		t.Fatalf("normalizeRoomName() = %q, want %q", got, "#ops")
+	}
+	if got := normalizeRoomName("#dev"); got != "#dev" {
+		t.Fatalf("normalizeRoomName() = %q, want %q", got, "#dev")
+	}
+	if !isValidRoomName("#ops") || isValidRoomName("#") || isValidRoomName("bad room") {
+		t.Fatal("isValidRoomName returned unexpected results")
+	}
+}
+
 func TestSanitizeForTerminal(t *testing.T) {
 	input := "\x1b[31mRed\x1b[0m\nline\t\x00text"
 	got := sanitizeForTerminal(input)
@@ -51,3 +63,15 @@ func TestSanitizeForTerminal(t *testing.T) {
 		t.Fatalf("sanitizeForTerminal() = %q, want %q", got, want)
 	}
 }
+
+func TestServerNamesAndUserAddresses(t *testing.T) {
+	if !isValidServerName("Hub-1.example") || isValidServerName("") || isValidServerName("bad name") || isValidServerName("a@b") {
+		t.Fatal("isValidServerName accepted or rejected an unexpected name")
+	}
+	if nick, server := splitUserAddress("alice@Hub-1"); nick != "alice" || server != "hub-1" {
+		t.Fatalf("splitUserAddress(alice@Hub-1) = (%q, %q)", nick, server)
+	}
+	if nick, server := splitUserAddress("alice"); nick != "alice" || server != "" {
+		t.Fatalf("splitUserAddress(alice) = (%q, %q)", nick, server)
+	}
+}